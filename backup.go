@@ -0,0 +1,246 @@
+package treestore_cmdline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jimsnab/go-lane"
+	"github.com/jimsnab/go-treestore"
+)
+
+const backupManifestName = "manifest.json"
+
+type (
+	// backupManifest describes the databases of a backup archive
+	backupManifest struct {
+		AppVersion int              `json:"app_version"`
+		Started    time.Time        `json:"started"`
+		Completed  time.Time        `json:"completed"`
+		Databases  []backupDbRecord `json:"databases"`
+	}
+
+	backupDbRecord struct {
+		Name   string `json:"name"`
+		File   string `json:"file"`
+		Size   int64  `json:"size"`
+		Sha256 string `json:"sha256"`
+	}
+)
+
+// Writes a snapshot of every database to dir, plus a manifest. Each
+// database is captured on its own, so writes are held off for one
+// database's serialization at a time, and the snapshots are not of a single
+// point in time. Users are not included.
+func (tss *treeStoreSet) backup(l lane.Lane, dir string) (manifest *backupManifest, err error) {
+	if _, err = os.Stat(filepath.Join(dir, backupManifestName)); err == nil {
+		err = fmt.Errorf("%s already contains a backup", dir)
+		return
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+
+	manifest = &backupManifest{
+		AppVersion: tss.appVersion,
+		Started:    time.Now(),
+		Databases:  []backupDbRecord{},
+	}
+
+	for _, name := range tss.dbNames() {
+		ts, exists := tss.getDb(l, name, false)
+		if !exists {
+			continue
+		}
+
+		var content []byte
+		var seq uint64
+		if content, seq, err = tss.captureDb(l, ts, name); err != nil {
+			return
+		}
+
+		record := backupDbRecord{Name: name, File: name + ".db"}
+		fileName := filepath.Join(dir, record.File)
+		if record.Size, err = commitSnapshot(content, fileName, seq); err != nil {
+			return
+		}
+		if record.Sha256, err = fileSha256(fileName); err != nil {
+			return
+		}
+		manifest.Databases = append(manifest.Databases, record)
+	}
+
+	manifest.Completed = time.Now()
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return
+	}
+
+	// the manifest is written last, so that an incomplete backup has none
+	manifestName := filepath.Join(dir, backupManifestName)
+	if err = os.WriteFile(manifestName+".tmp", data, 0600); err != nil {
+		return
+	}
+	if err = os.Rename(manifestName+".tmp", manifestName); err != nil {
+		return
+	}
+	if err = syncDir(dir); err != nil {
+		return
+	}
+
+	l.Infof("backed up %d database(s) to %s", len(manifest.Databases), dir)
+	return
+}
+
+// Replaces all databases with those of a backup archive. The archive is
+// validated and loaded completely before the live data is replaced, and
+// then the restored databases are saved.
+func (tss *treeStoreSet) restore(l lane.Lane, dir string) (manifest *backupManifest, err error) {
+	if manifest, err = readBackupManifest(dir); err != nil {
+		return
+	}
+
+	if manifest.AppVersion != tss.appVersion {
+		err = fmt.Errorf("backup app version %d is not compatible with app version %d", manifest.AppVersion, tss.appVersion)
+		return
+	}
+
+	dbs := map[string]*treestore.TreeStore{}
+	for _, record := range manifest.Databases {
+		if err = validateDbName(record.Name); err != nil {
+			return
+		}
+		if _, exists := dbs[record.Name]; exists {
+			err = fmt.Errorf("backup has more than one database %s", record.Name)
+			return
+		}
+		if filepath.Base(record.File) != record.File {
+			err = fmt.Errorf("backup file %s is not in the backup directory", record.File)
+			return
+		}
+
+		fileName := filepath.Join(dir, record.File)
+		var hash string
+		if hash, err = fileSha256(fileName); err != nil {
+			return
+		}
+		if hash != record.Sha256 {
+			err = fmt.Errorf("%w: %s does not match the backup manifest", errSnapshotChecksum, fileName)
+			return
+		}
+
+		ts := treestore.NewTreeStore(l.Derive(), tss.appVersion)
+		if _, err = loadSnapshot(l, ts, fileName); err != nil {
+			return
+		}
+		dbs[record.Name] = ts
+	}
+	if _, exists := dbs["main"]; !exists {
+		dbs["main"] = treestore.NewTreeStore(l.Derive(), tss.appVersion)
+	}
+
+	tss.saveMu.Lock()
+	defer tss.saveMu.Unlock()
+
+	tss.txMu.Lock()
+	tss.mu.Lock()
+	replaced := tss.dbs
+	tss.dbs = dbs
+	tss.mu.Unlock()
+
+	// watches fail and blocked clients wake up, as for any other change
+	for _, ts := range replaced {
+		tss.touchKeys(ts, "")
+	}
+
+	tss.dirtyMu.Lock()
+	tss.dirty = map[string]uint64{}
+	for name := range dbs {
+		tss.dirty[name] = 1
+	}
+	tss.dirtyMu.Unlock()
+
+	// clients move to the restored database of the same name, or to main
+	processAllClients(func(id int64, cs *clientState) {
+		if cs.tss == tss {
+			cs.reselectDb()
+		}
+	})
+	tss.txMu.Unlock()
+
+	l.Infof("restored %d database(s) from %s", len(manifest.Databases), dir)
+
+	if tss.basePath == "" {
+		return
+	}
+
+	if err = tss.saveLocked(l); err != nil {
+		return
+	}
+
+	// databases that are not in the backup no longer have files
+	for name := range replaced {
+		if _, exists := dbs[name]; !exists {
+			if err = os.Remove(tss.treeStoreFileName(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return
+			}
+			err = nil
+		}
+	}
+	return
+}
+
+// Resolves the backup directory named by a client, which must be a
+// subdirectory of the server's backup path.
+func (tss *treeStoreSet) backupDir(name string) (dir string, err error) {
+	if tss.backupPath == "" {
+		err = errors.New("the server is not configured with a backup path")
+		return
+	}
+	if !filepath.IsLocal(name) {
+		err = fmt.Errorf("backup directory %s must be a relative path within the backup path", name)
+		return
+	}
+	dir = filepath.Join(tss.backupPath, name)
+	return
+}
+
+func readBackupManifest(dir string) (manifest *backupManifest, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+	if err != nil {
+		return
+	}
+
+	manifest = &backupManifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		err = fmt.Errorf("invalid backup manifest in %s: %w", dir, err)
+		return
+	}
+
+	sort.Slice(manifest.Databases, func(i, j int) bool {
+		return manifest.Databases[i].Name < manifest.Databases[j].Name
+	})
+	return
+}
+
+func fileSha256(fileName string) (hash string, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return
+	}
+	hash = hex.EncodeToString(h.Sum(nil))
+	return
+}
@@ -2,16 +2,29 @@ package treestore_cmdline
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/jimsnab/go-cmdline"
 	"github.com/jimsnab/go-lane"
 	"github.com/jimsnab/go-treestore"
 )
@@ -35,6 +48,10 @@ func testSetup(t *testing.T) (tc *testClient) {
 		srv.WaitForTermination()
 	})
 
+	return testConnect(t, l)
+}
+
+func testConnect(t *testing.T, l lane.Lane) (tc *testClient) {
 	var cxn net.Conn
 	cxn, err := net.Dial("tcp", "localhost:6771")
 	if err != nil {
@@ -215,3 +232,2161 @@ func TestKeys(t *testing.T) {
 		t.Fatal("unexpected keys")
 	}
 }
+
+func TestSelectDb(t *testing.T) {
+	tc := testSetup(t)
+
+	sk := treestore.MakeStoreKey("tenant", "key")
+
+	res := tc.rawCommand(t, "select", "tenant1")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected error selecting a missing database")
+	}
+
+	res = tc.rawCommand(t, "select", "../tenant1", "--create")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected error creating a database with an invalid name")
+	}
+
+	res = tc.rawCommand(t, "select", "tenant1", "--create")
+	if res["prior"] != "main" {
+		t.Fatal("unexpected prior selection")
+	}
+
+	tc.rawCommand(t, "setk", string(sk.Path))
+
+	res = tc.rawCommand(t, "dbs")
+	dbs, _ := res["databases"].([]any)
+	if len(dbs) != 2 {
+		t.Fatal("wrong database count")
+	}
+
+	main := dbs[0].(map[string]any)
+	tenant := dbs[1].(map[string]any)
+	if main["name"] != "main" || main["keys"].(float64) != 0 || main["selected"].(bool) {
+		t.Fatal("unexpected main database info")
+	}
+	if tenant["name"] != "tenant1" || tenant["keys"].(float64) != 2 || !tenant["selected"].(bool) {
+		t.Fatal("unexpected tenant database info")
+	}
+
+	tc.rawCommand(t, "select", "main")
+	res = tc.rawCommand(t, "getk", string(sk.Path))
+	if _, exists := res["address"]; exists {
+		t.Fatal("key should not exist in main")
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	tc := testSetup(t)
+
+	// send all requests in a single write
+	var batch []byte
+	for i := 0; i < 100; i++ {
+		sk := treestore.MakeStoreKey("pipeline", fmt.Sprintf("%d", i))
+		joined := strings.Join([]string{"setv", string(sk.Path), fmt.Sprintf("value %d", i)}, "\n")
+
+		req := make([]byte, len(joined)+4)
+		binary.BigEndian.PutUint32(req, uint32(len(joined)))
+		copy(req[4:], []byte(joined))
+		batch = append(batch, req...)
+	}
+
+	if _, err := tc.cxn.Write(batch); err != nil {
+		t.Fatalf("failed to write requests: %s", err.Error())
+	}
+
+	responses := 0
+	for responses < 100 {
+		buffer := make([]byte, 1024*8)
+		tc.cxn.SetReadDeadline(time.Now().Add(20 * time.Second))
+		n, err := tc.cxn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.inbound = append(tc.inbound, buffer[0:n]...)
+
+		for {
+			length, response, err := tc.parseResponse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response == nil {
+				break
+			}
+			tc.inbound = tc.inbound[length:]
+
+			// responses arrive in request order, each setting a new key
+			if !resultBool(t, response, "firstValue") {
+				t.Fatalf("unexpected response %d", responses)
+			}
+			responses++
+		}
+	}
+
+	res := tc.rawCommand(t, "getv", string(treestore.MakeStoreKey("pipeline", "99").Path))
+	if res["value"] != "value 99" {
+		t.Fatal("unexpected value")
+	}
+}
+
+func TestPipelinedBlockingRequest(t *testing.T) {
+	tc := testSetup(t)
+
+	var batch []byte
+	for _, args := range [][]string{{"setv", "/key", "value"}, {"waitk", "/never", "--timeout", "2000"}} {
+		joined := strings.Join(args, "\n")
+		req := make([]byte, len(joined)+4)
+		binary.BigEndian.PutUint32(req, uint32(len(joined)))
+		copy(req[4:], []byte(joined))
+		batch = append(batch, req...)
+	}
+
+	if _, err := tc.cxn.Write(batch); err != nil {
+		t.Fatalf("failed to write requests: %s", err.Error())
+	}
+
+	// the first response is not held back by the wait
+	buffer := make([]byte, 1024*8)
+	tc.cxn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := tc.cxn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.inbound = append(tc.inbound, buffer[0:n]...)
+	_, response, err := tc.parseResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response == nil || !resultBool(t, response, "firstValue") {
+		t.Fatal("expected the first response before the wait completes")
+	}
+}
+
+func TestDispatchErrorTerminates(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	srv := NewTreeStoreCmdLineServer(l)
+	if err := srv.StartServer("localhost", 6771, "", 100, &testOpLog{failWith: errors.New("op log failure")}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.StopServer()
+		srv.WaitForTermination()
+	})
+
+	tc := testConnect(t, l)
+	req := []byte("\x00\x00\x00\x04setv")
+	if _, err := tc.cxn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection is closed, and the client is unregistered
+	tc.cxn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := tc.cxn.Read(make([]byte, 16)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the connection to close, got %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		connected := 0
+		processConnectedClients(func(id int64, cs *clientState) {
+			connected++
+		})
+		if connected == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the client to be unregistered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMultiExec(t *testing.T) {
+	tc := testSetup(t)
+
+	sk1 := treestore.MakeStoreKey("tx", "one")
+	sk2 := treestore.MakeStoreKey("tx", "two")
+
+	tc.rawCommand(t, "multi")
+
+	res := tc.rawCommand(t, "setv", string(sk1.Path), "1")
+	if !resultBool(t, res, "queued") {
+		t.Fatal("expected queued command")
+	}
+	tc.rawCommand(t, "setv", string(sk2.Path), "2")
+
+	res = tc.rawCommand(t, "multi")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected nested multi error")
+	}
+
+	res = tc.rawCommand(t, "exec")
+	results, _ := res["results"].([]any)
+	if len(results) != 2 {
+		t.Fatal("wrong result count")
+	}
+	if !results[1].(map[string]any)["firstValue"].(bool) {
+		t.Fatal("unexpected result")
+	}
+
+	res = tc.rawCommand(t, "getv", string(sk2.Path))
+	if res["value"] != "2" {
+		t.Fatal("unexpected value")
+	}
+
+	tc.rawCommand(t, "multi")
+	tc.rawCommand(t, "delk", string(sk1.Path))
+	res = tc.rawCommand(t, "discard")
+	if res["discarded"].(float64) != 1 {
+		t.Fatal("unexpected discard count")
+	}
+
+	res = tc.rawCommand(t, "getv", string(sk1.Path))
+	if res["value"] != "1" {
+		t.Fatal("discarded command was applied")
+	}
+
+	res = tc.rawCommand(t, "exec")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected exec error")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	tc := testSetup(t)
+	tc2 := testConnect(t, tc.l)
+
+	sk := treestore.MakeStoreKey("watched", "doc")
+	skChild := treestore.MakeStoreKey("watched", "doc", "field")
+
+	tc.rawCommand(t, "setjson", string(sk.Path), `{"field":1}`)
+
+	// an unmodified watch allows the write
+	tc.rawCommand(t, "watch", string(sk.Path))
+	res := tc.rawCommand(t, "setjson", string(sk.Path), `{"field":2}`)
+	if _, isError := res["error"]; isError {
+		t.Fatal("unexpected error")
+	}
+
+	// a change by another client fails the write
+	tc.rawCommand(t, "watch", string(sk.Path))
+	tc2.rawCommand(t, "setv", string(skChild.Path), "3")
+	res = tc.rawCommand(t, "setjson", string(sk.Path), `{"field":4}`)
+	if res["error"] != "watched key changed" {
+		t.Fatal("expected watch failure")
+	}
+
+	// the watch ended with the failed write
+	res = tc.rawCommand(t, "setjson", string(sk.Path), `{"field":5}`)
+	if _, isError := res["error"]; isError {
+		t.Fatal("unexpected error")
+	}
+
+	// a change fails a transaction
+	tc.rawCommand(t, "watch", "/other", string(sk.Path))
+	tc.rawCommand(t, "multi")
+	tc.rawCommand(t, "setv", string(skChild.Path), "6")
+	tc2.rawCommand(t, "deltree", string(sk.Path))
+	res = tc.rawCommand(t, "exec")
+	if res["error"] != "watched key changed" {
+		t.Fatal("expected watch failure")
+	}
+
+	// unwatch removes the condition
+	tc.rawCommand(t, "watch", string(sk.Path))
+	tc2.rawCommand(t, "setv", string(skChild.Path), "7")
+	tc.rawCommand(t, "unwatch")
+	res = tc.rawCommand(t, "setv", string(skChild.Path), "8")
+	if _, isError := res["error"]; isError {
+		t.Fatal("unexpected error")
+	}
+}
+
+func TestWaitKeyValue(t *testing.T) {
+	tc := testSetup(t)
+	tc2 := testConnect(t, tc.l)
+
+	sk := treestore.MakeStoreKey("wait", "key")
+
+	res := tc.rawCommand(t, "waitk", string(sk.Path), "--timeout", "50")
+	if resultBool(t, res, "exists") {
+		t.Fatal("key should not exist")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tc2.rawCommand(t, "setv", string(sk.Path), "first")
+		close(done)
+	}()
+
+	res = tc.rawCommand(t, "waitk", string(sk.Path), "--timeout", "5000")
+	if !resultBool(t, res, "exists") {
+		t.Fatal("key should exist")
+	}
+	<-done
+
+	res = tc.rawCommand(t, "waitv", string(sk.Path), "--timeout", "50")
+	if resultBool(t, res, "changed") {
+		t.Fatal("value should not have changed")
+	}
+
+	done = make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tc2.rawCommand(t, "setv", string(sk.Path), "second")
+		close(done)
+	}()
+
+	res = tc.rawCommand(t, "waitv", string(sk.Path), "--timeout", "5000")
+	if !resultBool(t, res, "changed") || res["value"] != "second" {
+		t.Fatal("value should have changed")
+	}
+	<-done
+
+	// the change is reported immediately when it happened after --since
+	since := fmt.Sprintf("%d", time.Now().Add(-time.Minute).UnixNano())
+	res = tc.rawCommand(t, "waitv", string(sk.Path), "--since", since)
+	if !resultBool(t, res, "changed") || res["value"] != "second" {
+		t.Fatal("value should have changed")
+	}
+
+	// a wait follows the client to main when its database is dropped
+	tc.rawCommand(t, "select", "tenant", "--create")
+	done = make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tc2.rawCommand(t, "dropdb", "tenant", "--destructive")
+		tc2.rawCommand(t, "setv", "/wait/other", "value")
+		close(done)
+	}()
+
+	res = tc.rawCommand(t, "waitk", "/wait/other", "--timeout", "5000")
+	if !resultBool(t, res, "exists") {
+		t.Fatal("key should exist in main")
+	}
+	<-done
+}
+
+func TestBlockingPop(t *testing.T) {
+	tc := testSetup(t)
+	tc2 := testConnect(t, tc.l)
+
+	sk := treestore.MakeStoreKey("queue")
+
+	res := tc.rawCommand(t, "bpop", string(sk.Path), "--timeout", "50")
+	if resultBool(t, res, "popped") {
+		t.Fatal("queue should be empty")
+	}
+
+	tc2.rawCommand(t, "stagejson", string(sk.Path), `{"job":1}`)
+	tc2.rawCommand(t, "stagejson", string(sk.Path), `{"job":2}`)
+
+	res = tc.rawCommand(t, "bpop", string(sk.Path))
+	if !resultBool(t, res, "popped") || res["data"].(map[string]any)["job"] != float64(1) {
+		t.Fatal("expected first job")
+	}
+
+	res = tc.rawCommand(t, "bpop", string(sk.Path))
+	if !resultBool(t, res, "popped") || res["data"].(map[string]any)["job"] != float64(2) {
+		t.Fatal("expected second job")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tc2.rawCommand(t, "stagejson", string(sk.Path), `{"job":3}`)
+		close(done)
+	}()
+
+	res = tc.rawCommand(t, "bpop", string(sk.Path), "--timeout", "5000")
+	if !resultBool(t, res, "popped") || res["data"].(map[string]any)["job"] != float64(3) {
+		t.Fatal("expected third job")
+	}
+	<-done
+
+	res = tc.rawCommand(t, "nodes", string(sk.Path), "*")
+	if len(resultStrArray(t, res, "segments")) != 0 {
+		t.Fatal("queue should be empty")
+	}
+}
+
+func TestClientCommands(t *testing.T) {
+	tc := testSetup(t)
+	tc2 := testConnect(t, tc.l)
+
+	tc.rawCommand(t, "client", "setname", "first")
+	res := tc.rawCommand(t, "client", "getname")
+	if res["name"] != "first" {
+		t.Fatal("unexpected name")
+	}
+
+	tc2.rawCommand(t, "client", "setname", "second")
+	res = tc2.rawCommand(t, "client", "id")
+	id2 := fmt.Sprintf("%d", int64(res["id"].(float64)))
+
+	res = tc.rawCommand(t, "client", "list")
+	clients, _ := res["clients"].([]any)
+	names := map[string]string{}
+	for _, c := range clients {
+		info := c.(map[string]any)
+		names[info["id"].(string)] = info["name"].(string)
+	}
+	if names[id2] != "second" {
+		t.Fatal("second client not listed")
+	}
+	if len(clients) != 2 {
+		t.Fatal("expected only the connected clients to be listed")
+	}
+
+	res = tc.rawCommand(t, "client", "list")
+	clients, _ = res["clients"].([]any)
+	for _, c := range clients {
+		info := c.(map[string]any)
+		if info["id"] == id2 {
+			if info["db"] != "main" || info["user"] != "default" || info["cmd"] != "" || info["cmds"] != "2" {
+				t.Fatal("unexpected client info")
+			}
+			if info["in"] == "0" || info["out"] == "0" {
+				t.Fatal("unexpected byte counts")
+			}
+		}
+	}
+
+	res = tc.rawCommand(t, "client", "kill")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected error for kill without filters")
+	}
+
+	// the internal client used by Dispatch has no name, but can't be killed
+	res = tc.rawCommand(t, "client", "kill", "--name", "")
+	if res["killed"].(float64) != 0 {
+		t.Fatal("expected no unnamed clients")
+	}
+
+	res = tc.rawCommand(t, "client", "kill", "--name", "second")
+	if res["killed"].(float64) != 1 {
+		t.Fatal("expected one client killed")
+	}
+
+	tc2.cxn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := tc2.cxn.Read(make([]byte, 16)); err == nil {
+		t.Fatal("expected killed connection to be closed")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	tc := testSetup(t)
+
+	res := tc.rawCommand(t, "acl", "requireauth")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected lockout prevention error")
+	}
+
+	res = tc.rawCommand(t, "acl", "setuser", "admin", "secret")
+	if !resultBool(t, res, "created") {
+		t.Fatal("expected user to be created")
+	}
+
+	res = tc.rawCommand(t, "auth", "admin", "wrong")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected auth failure")
+	}
+
+	tc.rawCommand(t, "auth", "admin", "secret")
+	res = tc.rawCommand(t, "acl", "whoami")
+	if res["user"] != "admin" {
+		t.Fatal("unexpected user")
+	}
+
+	tc.rawCommand(t, "acl", "requireauth")
+
+	tc2 := testConnect(t, tc.l)
+	res = tc2.rawCommand(t, "getk", "/key")
+	if res["error"] != "authentication required" {
+		t.Fatal("expected authentication required")
+	}
+
+	res = tc2.rawCommand(t, "auth", "default", "")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected passwordless auth failure")
+	}
+
+	tc2.rawCommand(t, "auth", "admin", "secret")
+	res = tc2.rawCommand(t, "getk", "/key")
+	if _, isError := res["error"]; isError {
+		t.Fatal("unexpected error")
+	}
+
+	users := resultStrArray(t, tc.rawCommand(t, "acl", "users"), "users")
+	if len(users) != 2 || users[0] != "admin" || users[1] != "default" {
+		t.Fatal("unexpected users")
+	}
+}
+
+func TestNoPassUsers(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	tss, err := newTreeStoreSet(l, "", 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := testDirectClient(t, l, tss)
+
+	// a user without a password hash is not open unless marked nopass
+	tss.mu.Lock()
+	tss.users["unset"] = newTreeStoreUser()
+	tss.mu.Unlock()
+	if _, isError := dispatch("auth", "unset", "anything")["error"]; !isError {
+		t.Fatal("expected auth failure for a user without a password")
+	}
+
+	if _, isError := dispatch("acl", "setuser", "guest")["error"]; !isError {
+		t.Fatal("expected a password or --nopass to be required")
+	}
+	if _, isError := dispatch("acl", "setuser", "guest", "secret", "--nopass")["error"]; !isError {
+		t.Fatal("expected a password and --nopass to conflict")
+	}
+
+	if !resultBool(t, dispatch("acl", "setuser", "guest", "--nopass"), "created") {
+		t.Fatal("expected user to be created")
+	}
+	if perms := dispatch("acl", "getuser", "guest")["user"].(map[string]any); !perms["nopass"].(bool) {
+		t.Fatal("expected user to be nopass")
+	}
+	dispatch("auth", "guest", "anything")
+	if dispatch("acl", "whoami")["user"] != "guest" {
+		t.Fatal("expected nopass auth to succeed")
+	}
+
+	dispatch("acl", "setuser", "guest", "secret")
+	if _, isError := dispatch("auth", "guest", "anything")["error"]; !isError {
+		t.Fatal("expected a password to replace nopass")
+	}
+}
+
+type testOpLog struct {
+	requests [][][]byte
+	modifies []bool
+	failWith error
+}
+
+func (tol *testOpLog) OpLogRequest(reqNumber uint64, modify bool, req [][]byte) (err error) {
+	tol.requests = append(tol.requests, req)
+	tol.modifies = append(tol.modifies, modify)
+	return
+}
+
+func (tol *testOpLog) OpLogResult(reqNumber uint64, modify bool, res []byte) (err error) {
+	err = tol.failWith
+	return
+}
+
+func TestPasswordsRedacted(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	tss, err := newTreeStoreSet(l, "", 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tol := &testOpLog{}
+	dispatch := testDirectClientWithOpLog(t, l, tss, tol)
+
+	dispatch("acl", "setuser", "admin", "secret")
+	dispatch("auth", "admin", "secret")
+
+	if len(tol.requests) != 2 {
+		t.Fatal("unexpected op log requests")
+	}
+	for _, req := range tol.requests {
+		for _, arg := range req {
+			if string(arg) == "secret" {
+				t.Fatal("password was passed to the op log")
+			}
+		}
+	}
+	if dispatch("acl", "whoami")["user"] != "admin" {
+		t.Fatal("expected auth to succeed")
+	}
+}
+
+func TestUsersPersisted(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tss.setUserPassword(l, "admin", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	if err = tss.setAuthRequired(l, true); err != nil {
+		t.Fatal(err)
+	}
+
+	tss, err = newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsu, exists := tss.getUser("admin")
+	if !exists || !tsu.checkPassword("secret") || tsu.checkPassword("wrong") {
+		t.Fatal("user not restored")
+	}
+	if !tss.isAuthRequired() {
+		t.Fatal("require auth not restored")
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	tc := testSetup(t)
+
+	tc.rawCommand(t, "acl", "setuser", "reports", "secret")
+	tc.rawCommand(t, "acl", "setperms", "reports", "--category", "read", "--keypattern", "/reports/**", "--db", "main")
+	tc.rawCommand(t, "setv", "/reports/daily", "ok")
+	tc.rawCommand(t, "setv", "/private/data", "secret")
+
+	res := tc.rawCommand(t, "acl", "getuser", "reports")
+	perms := res["user"].(map[string]any)
+	if perms["categories"].([]any)[0] != "read" || !perms["has_password"].(bool) {
+		t.Fatal("unexpected permissions")
+	}
+
+	tc2 := testConnect(t, tc.l)
+	tc2.rawCommand(t, "auth", "reports", "secret")
+
+	res = tc2.rawCommand(t, "getv", "/reports/daily")
+	if res["value"] != "ok" {
+		t.Fatal("expected read access to reports")
+	}
+
+	res = tc2.rawCommand(t, "lsk", "/reports/*")
+	if _, isError := res["error"]; isError {
+		t.Fatal("expected pattern access to reports")
+	}
+
+	res = tc2.rawCommand(t, "nodes", "/reports", "*")
+	if _, isError := res["error"]; isError {
+		t.Fatal("expected relative pattern access to reports")
+	}
+
+	tc.rawCommand(t, "select", "other", "--create")
+	dbs := tc2.rawCommand(t, "dbs")["databases"].([]any)
+	if len(dbs) != 1 || dbs[0].(map[string]any)["name"] != "main" {
+		t.Fatal("expected only permitted databases to be listed")
+	}
+
+	expectDenied := func(args ...string) {
+		res := tc2.rawCommand(t, args...)
+		errText, _ := res["error"].(string)
+		if !strings.HasPrefix(errText, "permission denied") {
+			t.Fatalf("expected %s to be denied", args[0])
+		}
+	}
+
+	expectDenied("setv", "/reports/daily", "changed")
+	expectDenied("getv", "/private/data")
+	expectDenied("lsk", "/**")
+	expectDenied("nodes", "/", "*")
+	expectDenied("addrv", "1")
+	expectDenied("client", "list")
+	expectDenied("select", "other")
+
+	tc2.rawCommand(t, "multi")
+	expectDenied("getv", "/private/data")
+	tc2.rawCommand(t, "discard")
+
+	// relationships reach keys by address, outside of the key patterns
+	tc.rawCommand(t, "select", "main")
+	privateAddr := resultAddress(t, tc.rawCommand(t, "getk", "/private/data"), "address")
+	tc.rawCommand(t, "setex", "/reports/link", "--relationships", fmt.Sprintf("%d", privateAddr))
+	tc.rawCommand(t, "acl", "setperms", "reports", "--category", "read", "--category", "write")
+
+	expectDenied("follow", "/reports/link", "0")
+	expectDenied("setex", "/reports/new", "--relationships", fmt.Sprintf("%d", privateAddr))
+	expectDenied("setjson", "/reports/json", `{"link":"/private/data"}`, "--straskey")
+	expectDenied("getjson", "/reports", "--straskey")
+
+	res = tc2.rawCommand(t, "setjson", "/reports/json", `{"field":"value"}`)
+	if _, isError := res["error"]; isError {
+		t.Fatal("expected setjson without --straskey to be permitted")
+	}
+}
+
+func testWriteCert(t *testing.T, dir, name string, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err = os.WriteFile(filepath.Join(dir, name+".crt"), certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, name+".key"), keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestTlsServer(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+
+	caCert, caKey := testWriteCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+
+	testWriteCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+
+	testWriteCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "reports"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, caKey)
+
+	srv := NewTreeStoreCmdLineServer(l)
+	err := srv.StartServerWithOptions(ServerOptions{
+		Endpoint:   "localhost",
+		Port:       6771,
+		AppVersion: 100,
+		Tls: &TlsOptions{
+			CertFile:          filepath.Join(dir, "server.crt"),
+			KeyFile:           filepath.Join(dir, "server.key"),
+			ClientCaFile:      filepath.Join(dir, "ca.crt"),
+			RequireClientCert: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.StopServer()
+		srv.WaitForTermination()
+
+		// the certificate reloader is released when the server stops
+		if srv.(*mainEngine).tlsReloader != nil {
+			t.Error("expected the certificate reloader to be cleared")
+		}
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cxn, err := tls.Dial("tcp", "localhost:6771", &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	if err != nil {
+		t.Fatalf("can't connect: %s", err.Error())
+	}
+	tc := &testClient{l: l, cxn: cxn}
+
+	tc.rawCommand(t, "setv", "/key", "secure")
+	res := tc.rawCommand(t, "getv", "/key")
+	if res["value"] != "secure" {
+		t.Fatal("unexpected value")
+	}
+
+	res = tc.rawCommand(t, "client", "list")
+	clients, _ := res["clients"].([]any)
+	subjects := []string{}
+	for _, c := range clients {
+		info := c.(map[string]any)
+		if info["subject"] != "" {
+			subjects = append(subjects, info["subject"].(string))
+		}
+	}
+	if len(subjects) != 1 || subjects[0] != "CN=reports" {
+		t.Fatal("unexpected client certificate subject")
+	}
+
+	// a client that connects and never starts the handshake doesn't hold
+	// up client list
+	stalled, err := net.Dial("tcp", "localhost:6771")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	cxn.SetDeadline(time.Now().Add(5 * time.Second))
+	res = tc.rawCommand(t, "client", "list")
+	if clients, _ = res["clients"].([]any); len(clients) != 2 {
+		t.Fatal("expected the stalled client to be listed")
+	}
+	cxn.SetDeadline(time.Time{})
+
+	// a client without a certificate is rejected
+	cxn2, err := tls.Dial("tcp", "localhost:6771", &tls.Config{RootCAs: roots})
+	if err == nil {
+		cxn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = cxn2.Read(make([]byte, 16))
+		cxn2.Close()
+	}
+	if err == nil {
+		t.Fatal("expected connection without client certificate to fail")
+	}
+}
+
+func TestUnixServer(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	socketPath := filepath.Join(t.TempDir(), "treestore.sock")
+
+	// leave a stale socket file behind
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv := NewTreeStoreCmdLineServer(l)
+	if err = srv.StartServerWithOptions(ServerOptions{SocketPath: socketPath, AppVersion: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	cxn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("can't connect: %s", err.Error())
+	}
+	tc := &testClient{l: l, cxn: cxn}
+
+	tc.rawCommand(t, "setv", "/key", "local")
+	res := tc.rawCommand(t, "getv", "/key")
+	if res["value"] != "local" {
+		t.Fatal("unexpected value")
+	}
+
+	res = tc.rawCommand(t, "client", "list")
+	if clients, _ := res["clients"].([]any); len(clients) != 1 {
+		t.Fatal("unexpected client list")
+	}
+
+	srv2 := NewTreeStoreCmdLineServer(l)
+	if err = srv2.StartServerWithOptions(ServerOptions{SocketPath: socketPath, AppVersion: 100}); err == nil {
+		t.Fatal("expected socket in use error")
+	}
+
+	srv.StopServer()
+	srv.WaitForTermination()
+
+	if _, err = os.Stat(socketPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected socket file to be removed")
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+
+	invalid := []ServerOptions{
+		{Port: -1},
+		{Port: 65536},
+		{SocketPath: "/tmp/treestore.sock", Port: 6771},
+		{SocketPath: "/tmp/treestore.sock", Tls: &TlsOptions{}},
+		{Tls: &TlsOptions{CertFile: "server.crt"}},
+	}
+	for _, opts := range invalid {
+		srv := NewTreeStoreCmdLineServer(l)
+		if err := srv.StartServerWithOptions(opts); err == nil {
+			t.Fatalf("expected options %+v to be rejected", opts)
+		}
+	}
+
+	srv := NewTreeStoreCmdLineServer(l)
+	err := srv.StartServerWithOptions(ServerOptions{
+		Endpoint:    "localhost",
+		Port:        6771,
+		PersistPath: t.TempDir() + "/test",
+		AppVersion:  100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.StopServer()
+		srv.WaitForTermination()
+	})
+
+	if err = srv.StartServerWithOptions(ServerOptions{}); err == nil {
+		t.Fatal("expected already started error")
+	}
+
+	// a failed start leaves nothing running
+	srv2 := NewTreeStoreCmdLineServer(l)
+	err = srv2.StartServerWithOptions(ServerOptions{
+		Endpoint:    "localhost",
+		Port:        6771,
+		PersistPath: t.TempDir() + "/test",
+		AppVersion:  100,
+		WriteLog:    true,
+	})
+	if err == nil {
+		t.Fatal("expected port in use error")
+	}
+	if eng := srv2.(*mainEngine); eng.exitSaver != nil || eng.tss.wlog.Load() != nil {
+		t.Fatal("expected saver and write log to be stopped")
+	}
+
+	tc := testConnect(t, l)
+	tc.rawCommand(t, "setv", "/key", "value")
+	res := tc.rawCommand(t, "getv", "/key")
+	if res["value"] != "value" {
+		t.Fatal("unexpected value")
+	}
+}
+
+// Makes a function that dispatches commands to a treestore set without a
+// server, as a client that is not connected by a socket.
+func testDirectClient(t *testing.T, l lane.Lane, tss *treeStoreSet) func(args ...string) map[string]any {
+	return testDirectClientWithOpLog(t, l, tss, nil)
+}
+
+func testDirectClientWithOpLog(t *testing.T, l lane.Lane, tss *treeStoreSet, opLog OpLogHandler) func(args ...string) map[string]any {
+	cd := newCmdDispatcher(0, "", tss, opLog)
+	cc := &clientCxn{csceCh: make(chan *clientStateEvent, 3)}
+	cs := newClientState(l, cc, cd)
+	cc.cs = cs
+	t.Cleanup(cs.unregister)
+
+	return func(args ...string) (response map[string]any) {
+		escapedArgs := [][]byte{}
+		for _, arg := range args {
+			escapedArgs = append(escapedArgs, []byte(arg))
+		}
+		output, err := cd.dispatchHandler(l, cs, newRawRequest(escapedArgs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(output, &response); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+}
+
+func TestWriteLogReplay(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tss.openWriteLog(l, WriteLogFsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatch := testDirectClient(t, l, tss)
+
+	dispatch("setv", "/key", "one")
+	dispatch("setv", "/gone", "two")
+	dispatch("delk", "/gone")
+	dispatch("getv", "/key")
+	dispatch("select", "other", "--create")
+	dispatch("setv", "/key", "three")
+
+	// simulate a crash that leaves a torn record at the end of the log
+	tss.closeWriteLog()
+	f, err := os.OpenFile(basePath+".writelog", os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeWriteLogRecord(100, "main", []string{"setv", "/torn", "x"})[:10])
+	f.Close()
+
+	tss, err = newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue := func(db, key, expected string) {
+		ts, _ := tss.getDb(l, db, false)
+		val, _, exists := ts.GetKeyValue(treestore.MakeStoreKeyFromPath(treestore.TokenPath(key)))
+		if expected == "" {
+			if exists {
+				t.Fatalf("%s %s should not exist", db, key)
+			}
+		} else if valBytes, _ := val.([]byte); !exists || string(valBytes) != expected {
+			t.Fatalf("%s %s not replayed", db, key)
+		}
+	}
+
+	expectValue("main", "/key", "one")
+	expectValue("main", "/gone", "")
+	expectValue("main", "/torn", "")
+	expectValue("other", "/key", "three")
+
+	// the replay is saved to a snapshot and the log is discarded
+	if _, err = os.Stat(basePath + ".writelog"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected write log to be removed")
+	}
+	tss, err = newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue("other", "/key", "three")
+}
+
+func TestWriteLogOversizedRecord(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	fileName := t.TempDir() + "/test.writelog"
+
+	record := encodeWriteLogRecord(1, "main", []string{"setv", "/key", "one"})
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, 0xFFFFFFF0)
+	if err := os.WriteFile(fileName, append(record, header...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the length in the torn header is not allocated, and the header is
+	// cut from the log
+	records, err := replayWriteLog(l, fileName, func(seq uint64, index string, args []string) error {
+		return nil
+	})
+	if err != nil || records != 1 {
+		t.Fatal("expected the record before the torn header to replay")
+	}
+	if fi, err := os.Stat(fileName); err != nil || fi.Size() != int64(len(record)) {
+		t.Fatal("expected the torn header to be discarded")
+	}
+}
+
+func TestWriteLogAppendError(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tss.openWriteLog(l, WriteLogFsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tss.closeWriteLog)
+
+	dispatch := testDirectClient(t, l, tss)
+	if _, isError := dispatch("setv", "/key", "one")["error"]; isError {
+		t.Fatal("unexpected error")
+	}
+
+	// a write that can't be logged is reported, rather than acknowledged
+	tss.wlog.Load().f.Close()
+	if _, isError := dispatch("setv", "/key", "two")["error"]; !isError {
+		t.Fatal("expected the log failure to be reported")
+	}
+	dispatch("select", "other", "--create")
+	if _, isError := dispatch("dropdb", "other")["error"]; !isError {
+		t.Fatal("expected the log failure of a drop to be reported")
+	}
+}
+
+func TestWriteLogReplayExpiration(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tss.openWriteLog(l, WriteLogFsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatch := testDirectClient(t, l, tss)
+
+	// a relative expiration is logged as absolute
+	expireNs := time.Now().Add(time.Hour).UnixNano()
+	relArgs := []string{"setex", "/relative", "--value", "value", "--sec", "-3600"}
+	absArgs := absoluteExpirationArgs(relArgs, expireNs)
+	if !reflect.DeepEqual(absArgs, []string{"setex", "/relative", "--value", "value", "--ns", strconv.FormatInt(expireNs, 10)}) {
+		t.Fatal("unexpected absolute args")
+	}
+	dispatch(absArgs...)
+	dispatch("setex", "/absolute", "--value", "value", "--sec", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+
+	ttlOf := func(key string) int64 {
+		ts, _ := tss.getDb(l, "main", false)
+		return ts.GetKeyTtl(treestore.MakeStoreKeyFromPath(treestore.TokenPath(key)))
+	}
+	relTtl := ttlOf("/relative")
+	absTtl := ttlOf("/absolute")
+	if relTtl != expireNs || absTtl <= 0 {
+		t.Fatal("unexpected expiration")
+	}
+
+	tss.closeWriteLog()
+	time.Sleep(10 * time.Millisecond)
+
+	tss, err = newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttlOf("/relative") != relTtl || ttlOf("/absolute") != absTtl {
+		t.Fatal("expiration not preserved by replay")
+	}
+}
+
+func TestWriteLogReplayKeyExpiration(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tss.openWriteLog(l, WriteLogFsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	cd := newCmdDispatcher(0, "", tss, nil)
+	cc := &clientCxn{csceCh: make(chan *clientStateEvent, 3)}
+	cs := newClientState(l, cc, cd)
+	cc.cs = cs
+	t.Cleanup(cs.unregister)
+
+	if _, err = cd.dispatchHandler(l, cs, newRawRequest([][]byte{[]byte("setk"), []byte("/key")})); err != nil {
+		t.Fatal(err)
+	}
+
+	// the command line can't pass a negative ttl, so the handler is called
+	// directly with a relative expiration
+	args := []string{"expirek", "/key", "-3600"}
+	ctx := &cmdContext{
+		l:        l,
+		response: map[string]any{},
+		cd:       cd,
+		cs:       cs,
+		req:      newRawRequest([][]byte{[]byte(args[0]), []byte(args[1]), []byte(args[2])}),
+	}
+	if err = fnSetKeyTtlSec(cmdline.Values{"": ctx, "key": args[1], "ttl": args[2]}); err != nil {
+		t.Fatal(err)
+	}
+
+	ttlOf := func() int64 {
+		ts, _ := tss.getDb(l, "main", false)
+		return ts.GetKeyTtl(treestore.MakeStoreKeyFromPath("/key"))
+	}
+	ttl := ttlOf()
+	if ttl < time.Now().Add(59*time.Minute).UnixNano() || ttl > time.Now().Add(time.Hour).UnixNano() {
+		t.Fatal("unexpected expiration")
+	}
+
+	tss.closeWriteLog()
+	time.Sleep(10 * time.Millisecond)
+
+	tss, err = newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttlOf() != ttl {
+		t.Fatal("expiration not preserved by replay")
+	}
+}
+
+func TestWriteLogBlockingPop(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tss.openWriteLog(l, WriteLogFsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatch := testDirectClient(t, l, tss)
+	dispatch("setv", "/queue/1", "one")
+	dispatch("setv", "/queue/2", "two")
+	if res := dispatch("bpop", "/queue", "--timeout", "0"); res["key"] != "/queue/1" {
+		t.Fatal("expected the first child to pop")
+	}
+	tss.closeWriteLog()
+
+	// the pop is logged as the removal of the popped key
+	var logged [][]string
+	if _, err = replayWriteLog(l, basePath+".writelog", func(seq uint64, index string, args []string) error {
+		logged = append(logged, args)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(logged) != 3 || !reflect.DeepEqual(logged[2], []string{"deltree", "/queue/1"}) {
+		t.Fatalf("unexpected logged pop %v", logged)
+	}
+}
+
+func TestSaveDuringWrites(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tss.openWriteLog(l, WriteLogFsyncNever); err != nil {
+		t.Fatal(err)
+	}
+
+	// a large database keeps each serialization long enough for writes to
+	// land during it
+	dispatch := testDirectClient(t, l, tss)
+	var bulk strings.Builder
+	bulk.WriteString("{")
+	for n := 0; n < 20000; n++ {
+		if n > 0 {
+			bulk.WriteString(",")
+		}
+		fmt.Fprintf(&bulk, `"k%d":%d`, n, n)
+	}
+	bulk.WriteString("}")
+	dispatch("setjson", "/bulk", bulk.String())
+
+	// stagejson adds a new key each time it is applied, so a write that is
+	// both in a snapshot and replayed would be counted twice
+	const writes = 300
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < writes; n++ {
+			dispatch("stagejson", "/queue", fmt.Sprintf(`{"n":%d}`, n))
+		}
+	}()
+
+	saves := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			if err = tss.save(l); err != nil {
+				t.Fatal(err)
+			}
+			saves++
+		}
+	}
+	if saves == 0 {
+		t.Fatal("expected saves during the writes")
+	}
+
+	// simulate a crash after the last write is logged
+	tss.closeWriteLog()
+	tss, err = newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch = testDirectClient(t, l, tss)
+	if count := len(resultStrArray(t, dispatch("nodes", "/queue", "*"), "segments")); count != writes {
+		t.Fatalf("expected %d keys after replay, found %d", writes, count)
+	}
+}
+
+func TestSaveDirtyDbsOnly(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := testDirectClient(t, l, tss)
+
+	dispatch("select", "first", "--create")
+	dispatch("setv", "/key", "value")
+	dispatch("select", "second", "--create")
+	dispatch("getv", "/key")
+
+	if err = tss.save(l); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(tss.treeStoreFileName("first")); err != nil {
+		t.Fatal("expected modified database to be saved")
+	}
+	if _, err = os.Stat(tss.treeStoreFileName("second")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected unmodified database not to be saved")
+	}
+
+	// a database that fails to save stays dirty
+	if err = os.Mkdir(tss.treeStoreFileName("second"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	dispatch("setv", "/key", "value")
+	if err = tss.save(l); err == nil {
+		t.Fatal("expected save error")
+	}
+	if tss.dirty["second"] == 0 || tss.dirty["first"] != 0 {
+		t.Fatal("unexpected dirty state")
+	}
+
+	os.Remove(tss.treeStoreFileName("second"))
+	if err = tss.save(l); err != nil {
+		t.Fatal(err)
+	}
+	if len(tss.dirty) != 0 {
+		t.Fatal("expected no dirty databases")
+	}
+}
+
+func TestSnapshotQuarantine(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	dir := t.TempDir()
+	basePath := dir + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := testDirectClient(t, l, tss)
+
+	dispatch("setv", "/key", "main value")
+	dispatch("select", "other", "--create")
+	dispatch("setv", "/key", "other value")
+	if err = tss.save(l); err != nil {
+		t.Fatal(err)
+	}
+
+	// damage the content of one snapshot
+	fileName := tss.treeStoreFileName("other")
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xFF
+	if err = os.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = newTreeStoreSet(l, basePath, 100, false); !errors.Is(err, errSnapshotChecksum) {
+		t.Fatal("expected checksum error")
+	}
+
+	tss, err = newTreeStoreSet(l, basePath, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := tss.getDb(l, "other", false); exists {
+		t.Fatal("expected corrupt database to be skipped")
+	}
+	ts, _ := tss.getDb(l, "main", false)
+	if _, _, exists := ts.GetKeyValue(treestore.MakeStoreKeyFromPath("/key")); !exists {
+		t.Fatal("expected main database to load")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quarantined := 0
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "test.other.db.corrupt-") {
+			quarantined++
+		} else if strings.HasSuffix(entry.Name(), ".tmp") || entry.Name() == "test.other.db" {
+			t.Fatalf("unexpected file %s", entry.Name())
+		}
+	}
+	if quarantined != 1 {
+		t.Fatal("expected corrupt file to be quarantined")
+	}
+}
+
+func TestSaveCommands(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	srv := NewTreeStoreCmdLineServer(l)
+	err := srv.StartServerWithOptions(ServerOptions{
+		Endpoint:    "localhost",
+		Port:        6771,
+		PersistPath: t.TempDir() + "/test",
+		AppVersion:  100,
+		WriteLog:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.StopServer()
+		srv.WaitForTermination()
+	})
+
+	tc := testConnect(t, l)
+	tc.rawCommand(t, "setv", "/key", "value")
+
+	res := tc.rawCommand(t, "save")
+	if !resultBool(t, res, "saved") {
+		t.Fatal("expected save")
+	}
+
+	res = tc.rawCommand(t, "lastsave")
+	if res["timestamp"].(float64) == 0 || res["bytes"].(float64) == 0 {
+		t.Fatal("unexpected last save")
+	}
+	first := res["timestamp"].(float64)
+
+	tc.rawCommand(t, "multi")
+	tc.rawCommand(t, "save")
+	res = tc.rawCommand(t, "exec")
+	results := res["results"].([]any)
+	if _, isError := results[0].(map[string]any)["error"]; !isError {
+		t.Fatal("expected save in a transaction to fail")
+	}
+
+	time.Sleep(time.Second)
+	tc.rawCommand(t, "setv", "/key", "changed")
+	res = tc.rawCommand(t, "bgsave")
+	if !resultBool(t, res, "started") {
+		t.Fatal("expected background save")
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		res = tc.rawCommand(t, "lastsave")
+		if res["timestamp"].(float64) > first {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background save did not complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteLogSkipsSnapshotWrites(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+	logName := basePath + ".writelog"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tss.openWriteLog(l, WriteLogFsyncNever); err != nil {
+		t.Fatal(err)
+	}
+	dispatch := testDirectClient(t, l, tss)
+
+	dispatch("stagejson", "/queue", `{"n":1}`)
+	before, err := os.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tss.save(l); err != nil {
+		t.Fatal(err)
+	}
+	dispatch("stagejson", "/queue", `{"n":2}`)
+	tss.closeWriteLog()
+
+	// simulate a crash before the saved writes were discarded from the log
+	after, err := os.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(logName, append(before, after...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tss, err = newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, _ := tss.getDb(l, "main", false)
+	children := ts.GetLevelKeys(treestore.MakeStoreKeyFromPath("/queue"), "*", 0, 10)
+	if len(children) != 2 {
+		t.Fatalf("expected 2 staged keys, found %d", len(children))
+	}
+}
+
+func TestSavePolicyConfig(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	srv := NewTreeStoreCmdLineServer(l)
+	err := srv.StartServerWithOptions(ServerOptions{
+		Endpoint:            "localhost",
+		Port:                6771,
+		PersistPath:         t.TempDir() + "/test",
+		AppVersion:          100,
+		DisablePeriodicSave: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.StopServer()
+		srv.WaitForTermination()
+	})
+
+	tc := testConnect(t, l)
+	res := tc.rawCommand(t, "config", "get", "save")
+	if res["config"].(map[string]any)["save"] != "" {
+		t.Fatal("expected periodic save to be disabled")
+	}
+
+	tc.rawCommand(t, "setv", "/key", "value")
+	time.Sleep(1500 * time.Millisecond)
+	res = tc.rawCommand(t, "lastsave")
+	if res["timestamp"].(float64) != 0 {
+		t.Fatal("unexpected periodic save")
+	}
+
+	for _, invalid := range []string{"1", "0 1", "10 x"} {
+		res = tc.rawCommand(t, "config", "set", "save", invalid)
+		if _, isError := res["error"]; !isError {
+			t.Fatalf("expected %q to be rejected", invalid)
+		}
+	}
+
+	res = tc.rawCommand(t, "config", "set", "save", "3600 100  1 1")
+	if res["value"] != "3600 100 1 1" {
+		t.Fatal("unexpected save policy")
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		res = tc.rawCommand(t, "lastsave")
+		if res["timestamp"].(float64) != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("periodic save did not occur")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res = tc.rawCommand(t, "config", "get", "nonexistent")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected unknown setting error")
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+	backupPath := t.TempDir()
+	backupDir := filepath.Join(backupPath, "backup")
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := testDirectClient(t, l, tss)
+
+	dispatch("setv", "/key", "one")
+	dispatch("select", "other", "--create")
+	dispatch("setv", "/key", "two")
+
+	res := dispatch("backup", "backup")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected backup without a backup path to fail")
+	}
+
+	tss.backupPath = backupPath
+	res = dispatch("backup", "backup")
+	if res["databases"].(float64) != 2 {
+		t.Fatal("expected two databases in the backup")
+	}
+	res = dispatch("backup", "backup")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected backup over an existing backup to fail")
+	}
+	for _, dir := range []string{"../escape", t.TempDir()} {
+		res = dispatch("backup", dir)
+		if _, isError := res["error"]; !isError {
+			t.Fatalf("expected backup to %s to be rejected", dir)
+		}
+	}
+
+	dispatch("setv", "/key", "changed")
+	dispatch("select", "extra", "--create")
+	dispatch("setv", "/key", "three")
+	if err = tss.save(l); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := testDirectClient(t, l, tss)
+	watcher("select", "other")
+	watcher("watch", "/key")
+	watcher("multi")
+	watcher("getv", "/key")
+
+	res = dispatch("restore", "backup")
+	if _, isError := res["error"]; isError {
+		t.Fatal(res["error"])
+	}
+
+	// the restore changes watched keys
+	res = watcher("exec")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected watched exec to fail after restore")
+	}
+
+	// the client was using a database that isn't in the backup
+	res = dispatch("getv", "/key")
+	if res["value"] != "one" {
+		t.Fatal("expected client to move to main")
+	}
+	dispatch("select", "other")
+	res = dispatch("getv", "/key")
+	if res["value"] != "two" {
+		t.Fatal("expected restored value")
+	}
+	if _, err = os.Stat(tss.treeStoreFileName("extra")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected database file to be removed")
+	}
+
+	// the restore is persisted
+	tss, err = newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := tss.getDb(l, "extra", false); exists {
+		t.Fatal("unexpected database after restart")
+	}
+	ts, _ := tss.getDb(l, "other", false)
+	val, _, _ := ts.GetKeyValue(treestore.MakeStoreKeyFromPath(treestore.TokenPath("/key")))
+	if valBytes, _ := val.([]byte); string(valBytes) != "two" {
+		t.Fatal("expected restored value after restart")
+	}
+
+	// a backup of another app version is rejected
+	newer, err := newTreeStoreSet(l, t.TempDir()+"/newer", 101, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newer.restore(l, backupDir); err == nil {
+		t.Fatal("expected app version mismatch")
+	}
+
+	// so is a backup that was modified
+	f, err := os.OpenFile(filepath.Join(backupDir, "other.db"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("x"))
+	f.Close()
+	if _, err = tss.restore(l, backupDir); !errors.Is(err, errSnapshotChecksum) {
+		t.Fatal("expected checksum mismatch")
+	}
+}
+
+func TestDbFileDiscovery(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	dir := t.TempDir()
+	basePath := dir + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := testDirectClient(t, l, tss)
+
+	for _, invalid := range []string{"db1.old", "a/b", "", strings.Repeat("x", 65)} {
+		res := dispatch("select", invalid, "--create")
+		if _, isError := res["error"]; !isError {
+			t.Fatalf("expected database name %q to be rejected", invalid)
+		}
+	}
+
+	dispatch("select", "bdd", "--create")
+	dispatch("setv", "/key", "value")
+	if err = tss.save(l); err != nil {
+		t.Fatal(err)
+	}
+
+	res := dispatch("dbs")
+	dbs := res["databases"].([]any)
+	bdd := dbs[0].(map[string]any)
+	if bdd["name"] != "bdd" || bdd["path"] != basePath+".bdd.db" || bdd["size"].(float64) == 0 {
+		t.Fatal("unexpected database file info")
+	}
+
+	// files that are not databases of this base path are ignored
+	data, err := os.ReadFile(basePath + ".bdd.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(dir+"/sub", 0700)
+	for _, name := range []string{"test.db1.old.db", "test..db", "testx.main2.db", "other.main3.db", "sub/test.nested.db", "test.main4.db.bak"} {
+		if err = os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tss, err = newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := tss.dbNames(); len(names) != 2 || names[0] != "bdd" || names[1] != "main" {
+		t.Fatalf("unexpected databases %v", names)
+	}
+}
+
+func TestDatabaseCommandsModify(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	tss, err := newTreeStoreSet(l, "", 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tss.backupPath = t.TempDir()
+
+	tol := &testOpLog{}
+	dispatch := testDirectClientWithOpLog(t, l, tss, tol)
+
+	requests := [][]string{
+		{"backup", "backup"},
+		{"restore", "backup"},
+		{"select", "tenant", "--create"},
+		{"copydb", "tenant", "copy"},
+		{"renamedb", "copy", "renamed"},
+		{"dropdb", "tenant", "--destructive"},
+		{"flushall", "--destructive"},
+	}
+	for _, args := range requests {
+		if res := dispatch(args...); res["error"] != nil {
+			t.Fatal(res["error"])
+		}
+	}
+
+	for n, args := range requests {
+		if tol.modifies[n] != (args[0] != "backup" && args[0] != "select") {
+			t.Fatalf("unexpected modify classification of %s", args[0])
+		}
+	}
+}
+
+func TestDropDb(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tss.openWriteLog(l, WriteLogFsyncNever); err != nil {
+		t.Fatal(err)
+	}
+	dispatch := testDirectClient(t, l, tss)
+
+	dispatch("select", "tenant", "--create")
+	dispatch("setv", "/old", "value")
+	if err = tss.save(l); err != nil {
+		t.Fatal(err)
+	}
+	dispatch("setv", "/logged", "value")
+
+	res := dispatch("dropdb", "main", "--destructive")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected main to be kept")
+	}
+	res = dispatch("dropdb", "tenant")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected --destructive to be required")
+	}
+
+	res = dispatch("dropdb", "tenant", "--destructive")
+	if !resultBool(t, res, "dropped") {
+		t.Fatal("expected drop")
+	}
+	if _, err = os.Stat(basePath + ".tenant.db"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected database file to be removed")
+	}
+	res = dispatch("setv", "/main", "value")
+	if _, isError := res["error"]; isError {
+		t.Fatal(res["error"])
+	}
+	if names := tss.dbNames(); len(names) != 1 || names[0] != "main" {
+		t.Fatalf("unexpected databases %v", names)
+	}
+
+	// the recreated database does not get the dropped data on replay
+	dispatch("select", "tenant", "--create")
+	dispatch("setv", "/new", "value")
+	tss.closeWriteLog()
+
+	tss, err = newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch = testDirectClient(t, l, tss)
+	dispatch("select", "tenant")
+	for _, key := range []string{"/old", "/logged"} {
+		res = dispatch("getv", key)
+		if _, exists := res["value"]; exists {
+			t.Fatalf("dropped key %s was replayed", key)
+		}
+	}
+	res = dispatch("getv", "/new")
+	if res["value"] != "value" {
+		t.Fatal("expected key to be replayed")
+	}
+
+	res = dispatch("flushall", "--destructive")
+	if res["dropped"].(float64) != 1 {
+		t.Fatal("expected one database dropped")
+	}
+	res = dispatch("getv", "/main")
+	if _, exists := res["value"]; exists {
+		t.Fatal("expected main to be emptied")
+	}
+	if names := tss.dbNames(); len(names) != 1 || names[0] != "main" {
+		t.Fatalf("unexpected databases %v", names)
+	}
+}
+
+func TestCopyRenameDb(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tss.openWriteLog(l, WriteLogFsyncNever); err != nil {
+		t.Fatal(err)
+	}
+	dispatch := testDirectClient(t, l, tss)
+
+	dispatch("select", "prod", "--create")
+	dispatch("setv", "/key", "value")
+	dispatch("setmeta", "/key", "attr", "meta")
+	dispatch("expirek", "/key", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	dispatch("autolink", "/data", "/index", "--field", "name")
+	dispatch("stagejson", "/data", `{"name":"alpha"}`)
+	exported := dispatch("export", "")["data"]
+	if exported == nil {
+		t.Fatal("expected export")
+	}
+
+	res := dispatch("copydb", "prod", "scratch")
+	if !resultBool(t, res, "copied") {
+		t.Fatal(res["error"])
+	}
+	res = dispatch("copydb", "prod", "scratch")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected --overwrite to be required")
+	}
+
+	// the copy is independent of the source
+	dispatch("setv", "/key", "changed")
+	dispatch("select", "scratch")
+	if !reflect.DeepEqual(dispatch("export", "")["data"], exported) {
+		t.Fatal("copy does not match the source")
+	}
+
+	res = dispatch("copydb", "prod", "scratch", "--overwrite")
+	if !resultBool(t, res, "copied") {
+		t.Fatal(res["error"])
+	}
+	if dispatch("getv", "/key")["value"] != "changed" {
+		t.Fatal("expected client to use the replaced copy")
+	}
+
+	res = dispatch("renamedb", "scratch", "tenant")
+	if !resultBool(t, res, "renamed") {
+		t.Fatal(res["error"])
+	}
+	res = dispatch("renamedb", "prod", "tenant")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected rename over an existing database to fail")
+	}
+	res = dispatch("renamedb", "main", "other")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected main rename to fail")
+	}
+
+	// the client follows the database to its new name
+	dispatch("setv", "/after", "rename")
+	res = dispatch("dbs")
+	for _, db := range res["databases"].([]any) {
+		info := db.(map[string]any)
+		if info["name"] == "scratch" {
+			t.Fatal("expected scratch to be renamed")
+		}
+		if info["name"] == "tenant" && !info["selected"].(bool) {
+			t.Fatal("expected renamed database to be selected")
+		}
+	}
+	if _, err = os.Stat(basePath + ".scratch.db"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("expected old database file to be removed")
+	}
+
+	// replay after a crash has the renamed database only
+	tss.closeWriteLog()
+	tss, err = newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := tss.dbNames(); !reflect.DeepEqual(names, []string{"main", "prod", "tenant"}) {
+		t.Fatalf("unexpected databases %v", names)
+	}
+	dispatch = testDirectClient(t, l, tss)
+	dispatch("select", "tenant")
+	if dispatch("getv", "/after")["value"] != "rename" || dispatch("getv", "/key")["value"] != "changed" {
+		t.Fatal("unexpected renamed database content")
+	}
+}
+
+func TestCrossDbKeyTransfer(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	basePath := t.TempDir() + "/test"
+
+	tss, err := newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tss.openWriteLog(l, WriteLogFsyncNever); err != nil {
+		t.Fatal(err)
+	}
+	dispatch := testDirectClient(t, l, tss)
+
+	dispatch("select", "staging", "--create")
+	dispatch("setv", "/report", "top")
+	dispatch("setmeta", "/report", "attr", "meta")
+	dispatch("expirek", "/report", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	dispatch("setv", "/report/part", "child")
+	dispatch("setv", "/other", "value")
+
+	// without --tree, only the key itself is copied
+	res := dispatch("copyk", "/report", "/single", "--to-db", "main")
+	if !resultBool(t, res, "copied") {
+		t.Fatal("expected copy")
+	}
+	res = dispatch("copyk", "/report", "/report", "--to-db", "main", "--tree")
+	if !resultBool(t, res, "copied") {
+		t.Fatal("expected tree copy")
+	}
+	res = dispatch("copyk", "/other", "/report", "--to-db", "main")
+	if !resultBool(t, res, "exists") || resultBool(t, res, "copied") {
+		t.Fatal("expected copy without --overwrite to be skipped")
+	}
+	res = dispatch("copyk", "/report", "/report/part/nested", "--tree")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected copy into the source tree to fail")
+	}
+	res = dispatch("copyk", "/report", "/x", "--to-db", "missing")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected missing database error")
+	}
+
+	// without --tree, a key with children can't be moved
+	res = dispatch("movek", "/report", "/moved", "--to-db", "main")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected move of a key with children to fail")
+	}
+	if dispatch("getv", "/report")["value"] != "top" {
+		t.Fatal("expected source key to be unchanged")
+	}
+
+	res = dispatch("movek", "/other", "/moved", "--to-db", "main")
+	if !resultBool(t, res, "moved") {
+		t.Fatal("expected move")
+	}
+	if _, exists := dispatch("getv", "/other")["value"]; exists {
+		t.Fatal("expected source key to be removed")
+	}
+
+	expectMain := func() {
+		dispatch("select", "main")
+		defer dispatch("select", "staging")
+
+		if dispatch("getv", "/single")["value"] != "top" || dispatch("getv", "/report/part")["value"] != "child" {
+			t.Fatal("expected copied values")
+		}
+		if _, exists := dispatch("getv", "/single/part")["value"]; exists {
+			t.Fatal("unexpected child copied")
+		}
+		if dispatch("getmeta", "/single", "attr")["value"] != "meta" {
+			t.Fatal("expected copied metadata")
+		}
+		if ttl, _ := dispatch("ttlk", "/single")["ttl"].(string); ttl == "" || ttl == "0" {
+			t.Fatal("expected copied expiration")
+		}
+		if dispatch("getv", "/moved")["value"] != "value" {
+			t.Fatal("expected moved value")
+		}
+	}
+	expectMain()
+
+	// the transfers replay into the databases they modified
+	tss.closeWriteLog()
+	tss, err = newTreeStoreSet(l, basePath, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch = testDirectClient(t, l, tss)
+	dispatch("select", "staging")
+	expectMain()
+	if _, exists := dispatch("getv", "/other")["value"]; exists {
+		t.Fatal("expected move to be replayed")
+	}
+}
+
+func TestCopyKeyTree(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	tss, err := newTreeStoreSet(l, "", 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := testDirectClient(t, l, tss)
+
+	target := dispatch("setv", "/target", "linked")["address"].(float64)
+	expiration := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	dispatch("setex", "/templates/x", "--value", "template", "--value-type", "string", "--sec", expiration)
+	dispatch("setmeta", "/templates/x", "attr", "meta")
+	dispatch("setex", "/templates/x/link", "--value", "child", "--relationships", strconv.Itoa(int(target)))
+	dispatch("setmeta", "/templates/x/link", "attr", "child-meta")
+
+	res := dispatch("cpk", "/templates/x", "/users/42/x")
+	if !resultBool(t, res, "copied") {
+		t.Fatal("expected copy")
+	}
+	res = dispatch("getv", "/users/42/x")
+	if res["value"] != "template" || res["type"] != "string" {
+		t.Fatal("expected value type to be copied")
+	}
+	res = dispatch("follow", "/users/42/x/link", "0")
+	if res["key"] != "/target" {
+		t.Fatal("expected relationship to be copied")
+	}
+	if dispatch("ttlk", "/users/42/x")["ttl"] != "0" {
+		t.Fatal("unexpected expiration")
+	}
+	if _, exists := dispatch("getmeta", "/users/42/x/link", "attr")["value"]; exists {
+		t.Fatal("unexpected metadata")
+	}
+
+	res = dispatch("cpk", "/templates/x", "/users/42/x", "--with-meta")
+	if resultBool(t, res, "copied") {
+		t.Fatal("expected copy without --overwrite to be skipped")
+	}
+	res = dispatch("cpk", "/templates/x", "/users/42/x", "--overwrite", "--with-ttl", "--with-meta")
+	if !resultBool(t, res, "copied") {
+		t.Fatal("expected copy")
+	}
+	if dispatch("ttlk", "/users/42/x")["ttl"] != dispatch("ttlk", "/templates/x")["ttl"] {
+		t.Fatal("expected expiration to be copied")
+	}
+	if dispatch("getmeta", "/users/42/x/link", "attr")["value"] != "child-meta" {
+		t.Fatal("expected child metadata to be copied")
+	}
+
+	// the copy is independent of the source
+	dispatch("setv", "/users/42/x/link", "changed")
+	if dispatch("getv", "/templates/x/link")["value"] != "child" {
+		t.Fatal("expected source to be unchanged")
+	}
+
+	res = dispatch("cpk", "/templates", "/templates/x/nested")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected copy into the source tree to fail")
+	}
+	res = dispatch("cpk", "/missing", "/dest")
+	if resultBool(t, res, "exists") || resultBool(t, res, "copied") {
+		t.Fatal("expected missing source")
+	}
+}
+
+func TestInfo(t *testing.T) {
+	l := lane.NewTestingLane(context.Background())
+	srv := NewTreeStoreCmdLineServer(l)
+	err := srv.StartServerWithOptions(ServerOptions{
+		Endpoint:            "localhost",
+		Port:                6771,
+		PersistPath:         t.TempDir() + "/test",
+		AppVersion:          100,
+		DisablePeriodicSave: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.StopServer()
+		srv.WaitForTermination()
+	})
+
+	tc := testConnect(t, l)
+	tc.rawCommand(t, "setv", "/key", "value")
+	tc.rawCommand(t, "select", "other", "--create")
+
+	res := tc.rawCommand(t, "info")
+	server := res["server"].(map[string]any)
+	if server["address"] != srv.ServerAddr() || server["app_version"].(float64) != 100 {
+		t.Fatal("unexpected server info")
+	}
+	if res["clients"].(map[string]any)["connected"].(float64) != 1 {
+		t.Fatal("expected one connected client")
+	}
+	if res["stats"].(map[string]any)["commands_processed"].(float64) < 3 {
+		t.Fatal("expected commands to be counted")
+	}
+	persistence := res["persistence"].(map[string]any)
+	if !persistence["enabled"].(bool) || persistence["pending_changes"].(float64) != 1 || persistence["last_save"].(float64) != 0 {
+		t.Fatal("unexpected persistence info")
+	}
+	main := res["databases"].(map[string]any)["main"].(map[string]any)
+	if main["values"].(float64) != 1 || main["pending_changes"].(float64) != 1 {
+		t.Fatal("unexpected database info")
+	}
+
+	// the cached key counts follow modifications
+	tc.rawCommand(t, "select", "main")
+	tc.rawCommand(t, "setv", "/key2", "value")
+	res = tc.rawCommand(t, "info", "databases")
+	if res["databases"].(map[string]any)["main"].(map[string]any)["values"].(float64) != 2 {
+		t.Fatal("expected key counts to be updated")
+	}
+
+	tc.rawCommand(t, "save")
+	res = tc.rawCommand(t, "info", "persistence")
+	if _, exists := res["server"]; exists {
+		t.Fatal("expected only the requested section")
+	}
+	persistence = res["persistence"].(map[string]any)
+	if persistence["last_save"].(float64) == 0 || persistence["pending_changes"].(float64) != 0 || persistence["last_save_error"] != "" {
+		t.Fatal("expected save to be reported")
+	}
+
+	res = tc.rawCommand(t, "info", "nonexistent")
+	if _, isError := res["error"]; !isError {
+		t.Fatal("expected unknown section error")
+	}
+}
@@ -1,13 +1,17 @@
 package treestore_cmdline
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jimsnab/go-lane"
@@ -15,7 +19,8 @@ import (
 
 // The following client state machine progresses through the lifecycle
 // of a client connection. A client processes only one command at a
-// time.
+// time, but every complete request that has arrived is dispatched as a
+// batch, in order, so that a client can pipeline its requests.
 const (
 	csNone            cxnState = iota
 	csInitialize               // can progress to csWaitForCommand or csTerminate
@@ -33,7 +38,7 @@ type (
 	clientCxn struct {
 		cs          *clientState
 		started     time.Time
-		mu          sync.Mutex // synchronizes access to waiting, closing flags
+		mu          sync.Mutex // synchronizes access to waiting, closing flags and peerSubject
 		cxn         net.Conn
 		socketState cxnState
 		csceCh      chan *clientStateEvent
@@ -41,6 +46,9 @@ type (
 		closing     bool
 		inbound     []byte
 		respVersion int
+		peerSubject string
+		bytesIn     atomic.Uint64
+		bytesOut    atomic.Uint64
 	}
 )
 
@@ -63,24 +71,66 @@ func newClientCxn(l lane.Lane, cxn net.Conn, dispatcher *cmdDispatcher) *clientC
 
 func (cc *clientCxn) ClientInfo() []string {
 	since := time.Since(cc.started)
+	cmd, idle, cmds := cc.cs.activity()
+	db, _ := cc.cs.getSelectedDb()
 	return []string{
-		"addr=" + cc.cxn.RemoteAddr().String(),
-		"laddr=" + cc.cxn.LocalAddr().String(),
+		"id=" + fmt.Sprintf("%d", cc.cs.id),
+		"name=" + cc.cs.getName(),
+		"user=" + cc.cs.getUser(),
+		"db=" + db,
+		"cmd=" + cmd,
+		"addr=" + cc.remoteAddr(),
+		"laddr=" + cc.localAddr(),
+		"subject=" + cc.PeerCertificateSubject(),
 		"age=" + fmt.Sprintf("%d", int64(since.Seconds())),
+		"idle=" + fmt.Sprintf("%d", int64(idle.Seconds())),
+		"cmds=" + fmt.Sprintf("%d", cmds),
+		"in=" + fmt.Sprintf("%d", cc.bytesIn.Load()),
+		"out=" + fmt.Sprintf("%d", cc.bytesOut.Load()),
 	}
 }
 
 func (cc *clientCxn) MatchFilter(filter map[string]string) bool {
 	for k, v := range filter {
 		switch k {
+		case "id":
+			str := fmt.Sprintf("%d", cc.cs.id)
+			if v != str {
+				return false
+			}
+
+		case "name":
+			str := cc.cs.getName()
+			if v != str {
+				return false
+			}
+
+		case "user":
+			str := cc.cs.getUser()
+			if v != str {
+				return false
+			}
+
+		case "db":
+			str, _ := cc.cs.getSelectedDb()
+			if v != str {
+				return false
+			}
+
 		case "addr":
-			str := cc.cxn.RemoteAddr().String()
+			str := cc.remoteAddr()
 			if v != str {
 				return false
 			}
 
 		case "laddr":
-			str := cc.cxn.LocalAddr().String()
+			str := cc.localAddr()
+			if v != str {
+				return false
+			}
+
+		case "subject":
+			str := cc.PeerCertificateSubject()
 			if v != str {
 				return false
 			}
@@ -89,6 +139,22 @@ func (cc *clientCxn) MatchFilter(filter map[string]string) bool {
 	return true
 }
 
+// The direct client used by Dispatch does not have a socket, and its
+// addresses are empty.
+func (cc *clientCxn) remoteAddr() string {
+	if cc.cxn == nil {
+		return ""
+	}
+	return addrString(cc.cxn.RemoteAddr())
+}
+
+func (cc *clientCxn) localAddr() string {
+	if cc.cxn == nil {
+		return ""
+	}
+	return addrString(cc.cxn.LocalAddr())
+}
+
 func (cc *clientCxn) queueStateChange(newState cxnState, eventData any) {
 	cc.csceCh <- &clientStateEvent{
 		newState:  newState,
@@ -103,6 +169,7 @@ func (cc *clientCxn) RequestClose() {
 
 	if !cc.closing {
 		cc.closing = true
+		cc.cs.unblock("client closed", true)
 		if cc.waiting {
 			// in a blocking read, close the socket
 			cc.cxn.Close()
@@ -149,7 +216,7 @@ func (cc *clientCxn) run() {
 			cc.onInitialize()
 		case csTerminate:
 			cc.onTerminate()
-			cc.cs.l.Tracef("client %d at %s terminated", cc.cs.id, cc.cxn.RemoteAddr().String())
+			cc.cs.l.Tracef("client %d at %s terminated", cc.cs.id, cc.remoteAddr())
 			return
 		case csWaitForCommand:
 			if cc.closing {
@@ -158,7 +225,7 @@ func (cc *clientCxn) run() {
 				cc.onWaitForCommand()
 			}
 		case csDispatchCommand:
-			cc.onDispatchCommand(event.eventData.(rawRequest))
+			cc.onDispatchCommands(event.eventData.([]rawRequest))
 		}
 	}
 }
@@ -169,9 +236,52 @@ func (cc *clientCxn) onTerminate() {
 }
 
 func (cc *clientCxn) onInitialize() {
+	if tlsCxn, isTls := cc.cxn.(*tls.Conn); isTls {
+		if err := cc.handshake(tlsCxn); err != nil {
+			cc.cs.l.Infof("TLS handshake with %s failed: %s", cc.remoteAddr(), err)
+			cc.queueStateChange(csTerminate, nil)
+			return
+		}
+	}
 	cc.queueStateChange(csWaitForCommand, nil)
 }
 
+// Completes the TLS handshake before the first read, so that it is bounded
+// by a deadline, and so that the peer certificate is known without asking
+// the connection, which is locked for the duration of a handshake.
+func (cc *clientCxn) handshake(tlsCxn *tls.Conn) (err error) {
+	cc.mu.Lock()
+	cc.waiting = true
+	cc.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	err = tlsCxn.HandshakeContext(ctx)
+	cancel()
+
+	cc.mu.Lock()
+	cc.waiting = false
+	cc.mu.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	var subject string
+	state := tlsCxn.ConnectionState()
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		subject = state.VerifiedChains[0][0].Subject.String()
+	}
+
+	cc.mu.Lock()
+	cc.peerSubject = subject
+	cc.mu.Unlock()
+
+	if subject != "" {
+		cc.cs.l.Infof("client %s authenticated with certificate %s", cc.remoteAddr(), subject)
+	}
+	return
+}
+
 func (cc *clientCxn) onWaitForCommand() {
 	// new buffer required every time because cc.inbound is a slice of this buffer, not a copy
 	buffer := make([]byte, 1024*8)
@@ -188,14 +298,16 @@ func (cc *clientCxn) onWaitForCommand() {
 
 	if err != nil {
 		if !errors.Is(err, io.EOF) {
-			cc.cs.l.Debugf("read error from %s: %s", cc.cxn.RemoteAddr().String(), err)
+			cc.cs.l.Debugf("read error from %s: %s", cc.remoteAddr(), err)
 		} else {
-			cc.cs.l.Infof("client disconnected: %s", cc.cxn.RemoteAddr().String())
+			cc.cs.l.Infof("client disconnected: %s", cc.remoteAddr())
 		}
 		cc.queueStateChange(csTerminate, nil)
 		return
 	}
 
+	cc.bytesIn.Add(uint64(n))
+
 	if cc.inbound == nil {
 		cc.inbound = buffer[0:n]
 	} else {
@@ -204,15 +316,29 @@ func (cc *clientCxn) onWaitForCommand() {
 
 	cc.cs.l.Tracef("received %d bytes of command data from client", len(cc.inbound))
 
-	cmd, length := cc.parseCommand()
-	if length == 0 {
-		cc.queueStateChange(csWaitForCommand, nil)
-	} else if length > 0 {
+	// collect every complete request in the inbound data
+	cmds := []rawRequest{}
+	for {
+		cmd, length := cc.parseCommand()
+		if length == 0 {
+			break
+		} else if length < 0 {
+			// the requests before the malformed one are still answered,
+			// and then the client is closed
+			cc.cs.l.Infof("malformed command sent from client - terminating")
+			cc.mu.Lock()
+			cc.closing = true
+			cc.mu.Unlock()
+			break
+		}
 		cc.inbound = cc.inbound[length:]
-		cc.queueStateChange(csDispatchCommand, cmd)
+		cmds = append(cmds, cmd)
+	}
+
+	if len(cmds) == 0 {
+		cc.queueStateChange(csWaitForCommand, nil)
 	} else {
-		cc.cs.l.Infof("malformed command sent from client - terminating")
-		cc.queueStateChange(csTerminate, nil)
+		cc.queueStateChange(csDispatchCommand, cmds)
 	}
 }
 
@@ -251,7 +377,14 @@ func (cc *clientCxn) parseCommand() (req rawRequest, length int) {
 
 	packet := cc.inbound[4 : 4+packetSize]
 	escapedArgs := bytes.Split(packet, []byte("\n"))
+	req = newRawRequest(escapedArgs)
 
+	length = 4 + int(packetSize)
+	return
+}
+
+// Makes a request from value-escaped args.
+func newRawRequest(escapedArgs [][]byte) (req rawRequest) {
 	req = rawRequest{
 		exact: make([][]byte, 0, len(escapedArgs)),
 		args:  make([]string, 0, len(escapedArgs)),
@@ -265,49 +398,76 @@ func (cc *clientCxn) parseCommand() (req rawRequest, length int) {
 			req.exact = append(req.exact, valueUnescape(string(escapedArg)))
 		}
 	}
-
-	length = 4 + int(packetSize)
 	return
 }
 
-func (cc *clientCxn) onDispatchCommand(cmd rawRequest) {
+func (cc *clientCxn) onDispatchCommands(cmds []rawRequest) {
 	go func() {
-		response, err := cc.cs.dispatch(cmd)
-		if err != nil {
-			cc.cs.l.Debugf("dispatch error: %s", err)
-			cc.cxn.Close()
-			return
-		}
-
+		// responses are streamed back in request order
+		w := bufio.NewWriter(cc.cxn)
 		size := make([]byte, 4)
-		binary.BigEndian.PutUint32(size, uint32(len(response)))
 
-		n, err := cc.cxn.Write(size)
-		if err != nil {
-			cc.cs.l.Debugf("write error: %s", err)
-			cc.cxn.Close()
-			return
+		for _, cmd := range cmds {
+			// the responses so far are sent before a command that can
+			// wait, rather than being held back for the wait
+			if len(cmd.args) > 0 {
+				if _, isBlocking := blockingCommands[cmd.args[0]]; isBlocking && w.Buffered() > 0 {
+					if err := w.Flush(); err != nil {
+						cc.cs.l.Debugf("write error: %s", err)
+						cc.queueStateChange(csTerminate, nil)
+						return
+					}
+				}
+			}
+
+			response, err := cc.cs.dispatch(cmd)
+			if err != nil {
+				cc.cs.l.Debugf("dispatch error: %s", err)
+				w.Flush()
+				cc.queueStateChange(csTerminate, nil)
+				return
+			}
+
+			binary.BigEndian.PutUint32(size, uint32(len(response)))
+
+			if _, err = w.Write(size); err == nil {
+				_, err = w.Write(response)
+			}
+			if err != nil {
+				cc.cs.l.Debugf("write error: %s", err)
+				cc.queueStateChange(csTerminate, nil)
+				return
+			}
+			cc.bytesOut.Add(uint64(len(size) + len(response)))
 		}
 
-		n, err = cc.cxn.Write(response)
-		if err != nil {
+		n := w.Buffered()
+		if err := w.Flush(); err != nil {
 			cc.cs.l.Debugf("write error: %s", err)
-			cc.cxn.Close()
+			cc.queueStateChange(csTerminate, nil)
 		} else {
-			cc.cs.l.Tracef("wrote %d bytes", n)
+			cc.cs.l.Tracef("wrote %d bytes for %d command(s)", n, len(cmds))
 			cc.queueStateChange(csWaitForCommand, nil)
 		}
 	}()
 }
 
 func (cc *clientCxn) ServerAddr() string {
-	return cc.cxn.LocalAddr().String()
+	return addrString(cc.cxn.LocalAddr())
 }
 
 func (cc *clientCxn) ClientAddr() string {
-	return cc.cxn.RemoteAddr().String()
+	return addrString(cc.cxn.RemoteAddr())
 }
 
 func (cc *clientCxn) ServerNow() time.Time {
 	return time.Now()
 }
+
+// Returns the subject of the verified TLS client certificate, or an empty
+// string if the client did not authenticate with a certificate.
+func (cc *clientCxn) PeerCertificateSubject() string {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.peerSubject
+}
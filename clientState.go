@@ -1,7 +1,9 @@
 package treestore_cmdline
 
 import (
+	"errors"
 	"math/rand"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,6 +19,9 @@ const (
 	CS_CHECKING
 )
 
+// unblock reason of a blocking command that is waiting on a key change
+const unblockChanged = "changed"
+
 type (
 	unblockReason struct {
 		reason  string
@@ -49,6 +54,9 @@ type (
 		respVersion     int
 		noEvict         bool
 		multiInProgress bool
+		currentCmd      string
+		lastActivity    time.Time
+		cmdsProcessed   uint64
 	}
 )
 
@@ -58,17 +66,24 @@ var clients = map[int64]*clientState{}
 
 func newClientState(l lane.Lane, client TreeStoreClient, dispatcher *cmdDispatcher) *clientState {
 	cs := &clientState{
-		l:           l,
-		user:        "default",
-		client:      client,
-		disp:        dispatcher,
-		tss:         dispatcher.tss,
-		respVersion: 2,
-		unblockCh:   make(chan unblockReason, 1),
-		watches:     map[watchKey]uint64{},
+		l:            l,
+		user:         "default",
+		selectedDb:   "main",
+		client:       client,
+		disp:         dispatcher,
+		tss:          dispatcher.tss,
+		respVersion:  2,
+		lastActivity: time.Now(),
+		unblockCh:    make(chan unblockReason, 1),
+		watches:      map[watchKey]uint64{},
 	}
 
-	cs.ts, _ = cs.tss.getDb(l, "main", true)
+	cs.ts, _ = cs.tss.getDb(l, cs.selectedDb, true)
+
+	// when authentication is required, the client starts with no user
+	if cs.tss.isAuthRequired() {
+		cs.user = ""
+	}
 
 	clientsMu.Lock()
 	defer clientsMu.Unlock()
@@ -97,6 +112,16 @@ func processAllClients(op func(id int64, cs *clientState)) {
 	}
 }
 
+// Like processAllClients, but skips the internal client used by Dispatch,
+// which has no connection.
+func processConnectedClients(op func(id int64, cs *clientState)) {
+	processAllClients(func(id int64, cs *clientState) {
+		if cc, isCxn := cs.client.(*clientCxn); !isCxn || cc.cxn != nil {
+			op(id, cs)
+		}
+	})
+}
+
 func (cs *clientState) unregister() {
 	clientsMu.Lock()
 	defer clientsMu.Unlock()
@@ -106,6 +131,7 @@ func (cs *clientState) unregister() {
 
 func (cs *clientState) unregisterLocked() {
 	delete(clients, cs.id)
+	cs.unwatchAll()
 }
 
 func (cs *clientState) setLock(from, to int32) {
@@ -237,6 +263,54 @@ func (cs *clientState) isBlocked() bool {
 	}
 }
 
+func (cs *clientState) setName(name string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.name = name
+}
+
+func (cs *clientState) getName() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.name
+}
+
+func (cs *clientState) setUser(user string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.user = user
+}
+
+func (cs *clientState) getUser() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.user
+}
+
+// Tracks the command being dispatched for client introspection.
+func (cs *clientState) commandStarted(cmd string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.currentCmd = cmd
+	cs.lastActivity = time.Now()
+}
+
+func (cs *clientState) commandCompleted() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.currentCmd = ""
+	cs.lastActivity = time.Now()
+	cs.cmdsProcessed++
+}
+
+// Returns the command being dispatched (if any), the time since the client
+// last started or completed a command, and the number of commands processed.
+func (cs *clientState) activity() (cmd string, idle time.Duration, cmdsProcessed uint64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.currentCmd, time.Since(cs.lastActivity), cs.cmdsProcessed
+}
+
 func (cs *clientState) dispatch(req rawRequest) (output []byte, err error) {
 	return cs.disp.dispatchHandler(cs.l, cs, req)
 }
@@ -253,12 +327,98 @@ func (cs *clientState) isMultiInProgress() bool {
 	return cs.multiInProgress
 }
 
+// Puts the client in multi mode, where commands are queued until exec
+// or discard.
+func (cs *clientState) beginMulti() (err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.multiInProgress {
+		err = errors.New("multi calls cannot be nested")
+		return
+	}
+
+	cs.multiInProgress = true
+	cs.cmdQueue = &[]*cmdContext{}
+	return
+}
+
+// If multi mode is active, appends the command to the queue and returns
+// true.
+func (cs *clientState) queueIfMulti(ctx *cmdContext) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if !cs.multiInProgress {
+		return false
+	}
+
+	*cs.cmdQueue = append(*cs.cmdQueue, ctx)
+	return true
+}
+
+// Ends multi mode, returning the queued commands.
+func (cs *clientState) endMulti() (queue []*cmdContext, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if !cs.multiInProgress {
+		err = errors.New("multi is not in progress")
+		return
+	}
+
+	queue = *cs.cmdQueue
+	cs.multiInProgress = false
+	cs.cmdQueue = nil
+	return
+}
+
+// Watches a key in the selected database, recording its current version.
+func (cs *clientState) watch(key treestore.TokenPath) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	wk := watchKey{ts: cs.ts, key: strings.TrimSuffix(string(key), "/")}
+	if _, exists := cs.watches[wk]; !exists {
+		cs.watches[wk] = cs.tss.watchKey(wk)
+	}
+}
+
+func (cs *clientState) unwatchAll() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for wk := range cs.watches {
+		cs.tss.unwatchKey(wk)
+	}
+	cs.watches = map[watchKey]uint64{}
+}
+
+func (cs *clientState) hasWatches() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.watches) > 0
+}
+
+// Indicates if any watched key was modified since the watch was made.
+func (cs *clientState) watchesChanged() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for wk, version := range cs.watches {
+		if cs.tss.watchedKeyVersion(wk) != version {
+			return true
+		}
+	}
+	return false
+}
+
 func (cs *clientState) selectDb(index string, create bool) (priorSelection string, valid bool) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
 	priorSelection = cs.selectedDb
-	ts, valid := cs.tss.getDb(cs.l, index, true)
+	ts, valid := cs.tss.getDb(cs.l, index, create)
 	if !valid {
 		return
 	}
@@ -267,3 +427,33 @@ func (cs *clientState) selectDb(index string, create bool) (priorSelection strin
 	cs.ts = ts
 	return
 }
+
+// Follows the selected database to its new name.
+func (cs *clientState) renameSelectedDb(from, to string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.selectedDb == from {
+		cs.selectedDb = to
+	}
+}
+
+// Refreshes the selected database after the set of databases is replaced,
+// selecting main if the database no longer exists.
+func (cs *clientState) reselectDb() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	ts, valid := cs.tss.getDb(cs.l, cs.selectedDb, false)
+	if !valid {
+		cs.selectedDb = "main"
+		ts, _ = cs.tss.getDb(cs.l, cs.selectedDb, true)
+	}
+	cs.ts = ts
+}
+
+func (cs *clientState) getSelectedDb() (index string, ts *treestore.TreeStore) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.selectedDb, cs.ts
+}
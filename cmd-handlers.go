@@ -1,6 +1,7 @@
 package treestore_cmdline
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
@@ -10,6 +11,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jimsnab/go-cmdline"
 	"github.com/jimsnab/go-lane"
@@ -23,6 +25,10 @@ type (
 		cd       *cmdDispatcher
 		cs       *clientState
 		req      rawRequest
+		inExec   bool
+		replay   bool
+		logged   bool
+		logArgs  []string
 	}
 
 	levelKey struct {
@@ -54,8 +60,69 @@ type (
 		AutoLinkKey string   `json:"autolink_key"`
 		FieldPaths  []string `json:"field_paths"`
 	}
+
+	userPermissionsJson struct {
+		HasPassword bool     `json:"has_password"`
+		NoPass      bool     `json:"nopass"`
+		Categories  []string `json:"categories"`
+		Databases   []string `json:"databases"`
+		KeyPatterns []string `json:"key_patterns"`
+	}
+
+	dbInfoJson struct {
+		Name     string `json:"name"`
+		Keys     int    `json:"keys"`
+		Values   int    `json:"values"`
+		Selected bool   `json:"selected"`
+		Path     string `json:"path,omitempty"`
+		Size     int64  `json:"size"`
+	}
 )
 
+// Records a modification of the active database, which marks the
+// database for saving, invalidates any watches on the keys, and logs
+// the request (once) in the write log. The request is logged as
+// ctx.logArgs if a handler set them.
+func (ctx *cmdContext) modified(keys ...treestore.TokenPath) {
+	db, _ := ctx.cs.getSelectedDb()
+	ctx.cs.tss.markDirty(db)
+	ctx.cs.tss.touchKeys(ctx.cs.ts, keys...)
+
+	if !ctx.logged {
+		ctx.logged = true
+		logArgs := ctx.logArgs
+		if logArgs == nil {
+			logArgs = ctx.req.args
+		}
+		ctx.reportLogError(ctx.cs.tss.logWrite(db, logArgs))
+	}
+}
+
+// Records a modification of a database by name, for commands that can
+// modify databases other than the active one. The write is logged as args,
+// which replay applies to the named database, in place of the request.
+func (ctx *cmdContext) modifiedDb(index string, ts *treestore.TreeStore, args []string, keys ...treestore.TokenPath) {
+	ctx.logged = true
+	ctx.cs.tss.markDirty(index)
+	ctx.cs.tss.touchKeys(ts, keys...)
+	ctx.reportLogError(ctx.cs.tss.logWrite(index, args))
+}
+
+// A write that is applied but can't be logged is reported in the response,
+// so that the client doesn't take it to be durable.
+func (ctx *cmdContext) reportLogError(err error) {
+	if err != nil {
+		ctx.response["error"] = err.Error()
+	}
+}
+
+// Reports whether the request is queued by multi and run by exec, which
+// holds the transaction lock. Replayed writes also run as if in exec, but
+// without the lock.
+func (ctx *cmdContext) inTransaction() bool {
+	return ctx.inExec && !ctx.replay
+}
+
 func fnHelp(args cmdline.Values) (err error) {
 	ctx := args[""].(*cmdContext)
 	m := ctx.cd.cmdLine.Summary()
@@ -108,7 +175,7 @@ func fnSetKey(args cmdline.Values) (err error) {
 	ctx.response["exists"] = exists
 
 	if !exists {
-		ctx.cs.tss.dirty.Add(1)
+		ctx.modified(key)
 	}
 
 	return
@@ -124,7 +191,7 @@ func fnSetKeyIfExists(args cmdline.Values) (err error) {
 	ctx.response["exists"] = exists
 
 	if !exists {
-		ctx.cs.tss.dirty.Add(1)
+		ctx.modified(key)
 	}
 
 	return
@@ -273,7 +340,7 @@ func fnSetKeyValue(args cmdline.Values) (err error) {
 	ctx.response["address"] = address
 	ctx.response["firstValue"] = firstValue
 
-	ctx.cs.tss.dirty.Add(1)
+	ctx.modified(key)
 	return
 }
 
@@ -332,6 +399,12 @@ func setEx(args cmdline.Values, ctx *cmdContext, value any, flags treestore.SetE
 			return
 		}
 	}
+	if expireNs < -1 {
+		// a relative expiration is logged as the time it resolves to, so
+		// that a replay sets the same expiration
+		expireNs = time.Now().UTC().UnixNano() - expireNs
+		ctx.logArgs = absoluteExpirationArgs(ctx.req.args, expireNs)
+	}
 
 	var relationships []treestore.StoreAddress
 	if args["--relationships"].(bool) {
@@ -366,10 +439,25 @@ func setEx(args cmdline.Values, ctx *cmdContext, value any, flags treestore.SetE
 		}
 	}
 
-	ctx.cs.tss.dirty.Add(1)
+	ctx.modified(key)
 	return
 }
 
+// Returns a copy of a request's args with its --sec or --ns expiration
+// replaced by --ns with the absolute expiration.
+func absoluteExpirationArgs(args []string, expireNs int64) []string {
+	absArgs := make([]string, 0, len(args))
+	for n := 0; n < len(args); n++ {
+		if (args[n] == "--sec" || args[n] == "--ns") && n+1 < len(args) {
+			absArgs = append(absArgs, "--ns", strconv.FormatInt(expireNs, 10))
+			n++
+		} else {
+			absArgs = append(absArgs, args[n])
+		}
+	}
+	return absArgs
+}
+
 func fnSetExStr(args cmdline.Values) (err error) {
 	ctx := args[""].(*cmdContext)
 	value := treestore.TokenPath(args["value"].(string))
@@ -510,7 +598,7 @@ func fnClearKeyMetadata(args cmdline.Values) (err error) {
 	key := treestore.TokenPath(args["key"].(string))
 
 	ctx.cs.ts.ClearKeyMetadata(treestore.MakeStoreKeyFromPath(key))
-	ctx.cs.tss.dirty.Add(1)
+	ctx.modified(key)
 	return
 }
 
@@ -523,7 +611,7 @@ func fnClearMetadataAttribute(args cmdline.Values) (err error) {
 
 	if attribExists {
 		ctx.response["original_value"] = orgVal
-		ctx.cs.tss.dirty.Add(1)
+		ctx.modified(key)
 	}
 	return
 }
@@ -539,10 +627,10 @@ func fnDeleteKey(args cmdline.Values) (err error) {
 		if err = addValueToResponse(ctx, orgVal, "original"); err != nil {
 			return
 		}
-		ctx.cs.tss.dirty.Add(1)
+		ctx.modified(key)
 	}
 	if keyRemoved {
-		ctx.cs.tss.dirty.Add(1)
+		ctx.modified(key)
 	}
 	return
 }
@@ -558,7 +646,7 @@ func fnDeleteKeyWithValue(args cmdline.Values) (err error) {
 		if err = addValueToResponse(ctx, orgVal, "original"); err != nil {
 			return
 		}
-		ctx.cs.tss.dirty.Add(1)
+		ctx.modified(key)
 	}
 	return
 }
@@ -571,7 +659,7 @@ func fnDeleteKeyTree(args cmdline.Values) (err error) {
 
 	ctx.response["removed"] = removed
 	if removed {
-		ctx.cs.tss.dirty.Add(1)
+		ctx.modified(key)
 	}
 	return
 }
@@ -879,18 +967,16 @@ func fnLocateKey(args cmdline.Values) (err error) {
 func fnSetKeyTtlSec(args cmdline.Values) (err error) {
 	ctx := args[""].(*cmdContext)
 	key := treestore.TokenPath(args["key"].(string))
-	ttlStr := args["ttl"].(string)
-	ttl, err := strconv.ParseInt(ttlStr, 10, 64)
+	ttl, err := expireTtlArg(ctx, args, time.Second, "expirekns")
 	if err != nil {
 		return
 	}
-	ttl = ttl * (1000 * 1000 * 1000) // convert seconds to ns
 
 	exists := ctx.cs.ts.SetKeyTtl(treestore.MakeStoreKeyFromPath(key), ttl)
 	ctx.response["exists"] = exists
 
 	if exists {
-		ctx.cs.tss.dirty.Add(1)
+		ctx.modified(key)
 	}
 	return
 }
@@ -898,8 +984,7 @@ func fnSetKeyTtlSec(args cmdline.Values) (err error) {
 func fnSetKeyTtlNs(args cmdline.Values) (err error) {
 	ctx := args[""].(*cmdContext)
 	key := treestore.TokenPath(args["key"].(string))
-	ttlStr := args["ttl"].(string)
-	ttl, err := strconv.ParseInt(ttlStr, 10, 64)
+	ttl, err := expireTtlArg(ctx, args, 1, "expirekns")
 	if err != nil {
 		return
 	}
@@ -908,7 +993,7 @@ func fnSetKeyTtlNs(args cmdline.Values) (err error) {
 	ctx.response["exists"] = exists
 
 	if exists {
-		ctx.cs.tss.dirty.Add(1)
+		ctx.modified(key)
 	}
 	return
 }
@@ -916,18 +1001,16 @@ func fnSetKeyTtlNs(args cmdline.Values) (err error) {
 func fnSetKeyValueTtlSec(args cmdline.Values) (err error) {
 	ctx := args[""].(*cmdContext)
 	key := treestore.TokenPath(args["key"].(string))
-	ttlStr := args["ttl"].(string)
-	ttl, err := strconv.ParseInt(ttlStr, 10, 64)
+	ttl, err := expireTtlArg(ctx, args, time.Second, "expirevns")
 	if err != nil {
 		return
 	}
-	ttl = ttl * (1000 * 1000 * 1000) // convert seconds to ns
 
 	exists := ctx.cs.ts.SetKeyValueTtl(treestore.MakeStoreKeyFromPath(key), ttl)
 	ctx.response["exists"] = exists
 
 	if exists {
-		ctx.cs.tss.dirty.Add(1)
+		ctx.modified(key)
 	}
 	return
 }
@@ -935,8 +1018,7 @@ func fnSetKeyValueTtlSec(args cmdline.Values) (err error) {
 func fnSetKeyValueTtlNs(args cmdline.Values) (err error) {
 	ctx := args[""].(*cmdContext)
 	key := treestore.TokenPath(args["key"].(string))
-	ttlStr := args["ttl"].(string)
-	ttl, err := strconv.ParseInt(ttlStr, 10, 64)
+	ttl, err := expireTtlArg(ctx, args, 1, "expirevns")
 	if err != nil {
 		return
 	}
@@ -945,7 +1027,24 @@ func fnSetKeyValueTtlNs(args cmdline.Values) (err error) {
 	ctx.response["exists"] = exists
 
 	if exists {
-		ctx.cs.tss.dirty.Add(1)
+		ctx.modified(key)
+	}
+	return
+}
+
+// Parses the ttl of an expire command as ns. A relative ttl, which is
+// negative, is resolved to the time it refers to, and the write is logged
+// as the ns form of the command with that time, so that a replay sets the
+// same expiration.
+func expireTtlArg(ctx *cmdContext, args cmdline.Values, unit time.Duration, nsCommand string) (ttl int64, err error) {
+	if ttl, err = strconv.ParseInt(args["ttl"].(string), 10, 64); err != nil {
+		return
+	}
+	ttl = ttl * int64(unit)
+
+	if ttl < -1 {
+		ttl = time.Now().UTC().UnixNano() - ttl
+		ctx.logArgs = []string{nsCommand, args["key"].(string), strconv.FormatInt(ttl, 10)}
 	}
 	return
 }
@@ -961,7 +1060,7 @@ func fnSetMetadataAttribute(args cmdline.Values) (err error) {
 	ctx.response["key_exists"] = keyExists
 	ctx.response["prior_value"] = priorVal
 
-	ctx.cs.tss.dirty.Add(1)
+	ctx.modified(key)
 	return
 }
 
@@ -1063,7 +1162,7 @@ func fnImport(args cmdline.Values) (err error) {
 		return
 	}
 
-	ctx.cs.tss.dirty.Add(1)
+	ctx.modified(key)
 	return
 }
 
@@ -1120,7 +1219,7 @@ func fnSetKeyJson(args cmdline.Values) (err error) {
 
 	ctx.response["replaced"] = replaced
 	ctx.response["address"] = addr
-	ctx.cs.tss.dirty.Add(1)
+	ctx.modified(key)
 	return
 }
 
@@ -1150,7 +1249,7 @@ func fnCreateKeyJson(args cmdline.Values) (err error) {
 	if created {
 		ctx.response["address"] = addr
 	}
-	ctx.cs.tss.dirty.Add(1)
+	ctx.modified(key)
 	return
 }
 
@@ -1180,7 +1279,7 @@ func fnReplaceKeyJson(args cmdline.Values) (err error) {
 	if replaced {
 		ctx.response["address"] = addr
 	}
-	ctx.cs.tss.dirty.Add(1)
+	ctx.modified(key)
 	return
 }
 
@@ -1208,7 +1307,7 @@ func fnMergeJson(args cmdline.Values) (err error) {
 	}
 
 	ctx.response["address"] = addr
-	ctx.cs.tss.dirty.Add(1)
+	ctx.modified(key)
 	return
 }
 
@@ -1221,7 +1320,7 @@ func fnCalculateKeyValue(args cmdline.Values) (err error) {
 	if newVal != nil {
 		ctx.response["address"] = address
 		addValueToResponse(ctx, newVal, "")
-		ctx.cs.tss.dirty.Add(1)
+		ctx.modified(key)
 	}
 	return
 }
@@ -1251,7 +1350,7 @@ func fnStageKeyJson(args cmdline.Values) (err error) {
 
 	ctx.response["tempkey"] = tempSk.Path
 	ctx.response["address"] = addr
-	ctx.cs.tss.dirty.Add(1)
+	ctx.modified(key)
 	return
 }
 
@@ -1268,7 +1367,7 @@ func fnMoveKey(args cmdline.Values) (err error) {
 
 	ctx.response["exists"] = exists
 	ctx.response["moved"] = moved
-	ctx.cs.tss.dirty.Add(1)
+	ctx.modified(sk, dk)
 	return
 }
 
@@ -1289,6 +1388,11 @@ func fnMoveReferencedKey(args cmdline.Values) (err error) {
 			return
 		}
 	}
+	if expireNs < -1 {
+		// logged as absolute, like setex
+		expireNs = time.Now().UTC().UnixNano() - expireNs
+		ctx.logArgs = absoluteExpirationArgs(ctx.req.args, expireNs)
+	}
 
 	refArgs, specified := args["ref"].([]string)
 	if !specified {
@@ -1317,14 +1421,218 @@ func fnMoveReferencedKey(args cmdline.Values) (err error) {
 
 	ctx.response["exists"] = exists
 	ctx.response["moved"] = moved
-	ctx.cs.tss.dirty.Add(1)
+
+	touched := []treestore.TokenPath{sk, dk}
+	for _, ref := range refs {
+		touched = append(touched, ref.Path)
+	}
+	for _, unref := range unrefs {
+		touched = append(touched, unref.Path)
+	}
+	ctx.modified(touched...)
+	return
+}
+
+func fnCopyKeyTree(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	sk := treestore.TokenPath(args["src"].(string))
+	dk := treestore.TokenPath(args["dest"].(string))
+	oflag := args["--overwrite"].(bool)
+
+	srcSk := treestore.MakeStoreKeyFromPath(sk)
+	destSk := treestore.MakeStoreKeyFromPath(dk)
+	if isRelatedKey(string(srcSk.Path), string(destSk.Path)) {
+		err = errors.New("the source and destination keys can't contain one another")
+		return
+	}
+
+	node, err := exportKeyNode(ctx.cs.ts, srcSk)
+	if err != nil {
+		return
+	}
+	ctx.response["exists"] = node != nil
+	ctx.response["copied"] = false
+	if node == nil {
+		return
+	}
+
+	if _, destExists := ctx.cs.ts.LocateKey(destSk); destExists && !oflag {
+		return
+	}
+
+	// auto-links of the copy would be made in the same index as those of
+	// the source, so they aren't copied
+	omit := []string{"kals"}
+	if !args["--with-ttl"].(bool) {
+		omit = append(omit, "expiration")
+	}
+	if !args["--with-meta"].(bool) {
+		omit = append(omit, "metadata")
+	}
+	if err = omitExportedFields(node, omit, true); err != nil {
+		return
+	}
+
+	jsonData, err := json.Marshal(node)
+	if err != nil {
+		return
+	}
+	if err = ctx.cs.ts.Import(destSk, jsonData); err != nil {
+		return
+	}
+
+	ctx.response["copied"] = true
+	ctx.modified(dk)
+	return
+}
+
+// Exports a key and its children as the fields of the key node, which are
+// nil if the key doesn't exist.
+func exportKeyNode(ts *treestore.TreeStore, sk treestore.StoreKey) (node map[string]json.RawMessage, err error) {
+	jsonData, err := ts.Export(sk)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(jsonData, &node)
+	return
+}
+
+// Removes fields from an exported key node, and optionally from all of its
+// children.
+func omitExportedFields(node map[string]json.RawMessage, fields []string, recursive bool) (err error) {
+	for _, field := range fields {
+		delete(node, field)
+	}
+
+	children, hasChildren := node["children"]
+	if !recursive || !hasChildren {
+		return
+	}
+
+	var childNodes map[string]map[string]json.RawMessage
+	if err = json.Unmarshal(children, &childNodes); err != nil {
+		return
+	}
+	for _, child := range childNodes {
+		if err = omitExportedFields(child, fields, true); err != nil {
+			return
+		}
+	}
+	node["children"], err = json.Marshal(childNodes)
+	return
+}
+
+func fnCopyKey(args cmdline.Values) (err error) {
+	return transferKey(args, false)
+}
+
+func fnMoveKeyBetweenDbs(args cmdline.Values) (err error) {
+	return transferKey(args, true)
+}
+
+// Copies or moves a key, and optionally its subtree, to a key that can be
+// in another database. Without --tree, only the key's own value, metadata
+// and expiration are transferred, and a key with children can't be moved.
+func transferKey(args cmdline.Values, move bool) (err error) {
+	ctx := args[""].(*cmdContext)
+	sk := treestore.TokenPath(args["src"].(string))
+	dk := treestore.TokenPath(args["dest"].(string))
+	tree := args["--tree"].(bool)
+	oflag := args["--overwrite"].(bool)
+
+	fromDb, _ := ctx.cs.getSelectedDb()
+	toDb := fromDb
+	if args["--from-db"].(bool) {
+		fromDb = args["fromdb"].(string)
+	}
+	if args["--to-db"].(bool) {
+		toDb = args["todb"].(string)
+	}
+
+	srcTs, exists := ctx.cs.tss.getDb(ctx.l, fromDb, false)
+	if !exists {
+		err = fmt.Errorf("database %s does not exist", fromDb)
+		return
+	}
+	destTs, exists := ctx.cs.tss.getDb(ctx.l, toDb, false)
+	if !exists {
+		err = fmt.Errorf("database %s does not exist", toDb)
+		return
+	}
+
+	srcSk := treestore.MakeStoreKeyFromPath(sk)
+	destSk := treestore.MakeStoreKeyFromPath(dk)
+	if fromDb == toDb && isRelatedKey(string(srcSk.Path), string(destSk.Path)) {
+		err = errors.New("the source and destination keys can't contain one another")
+		return
+	}
+
+	node, err := exportKeyNode(srcTs, srcSk)
+	if err != nil {
+		return
+	}
+
+	resultName := "copied"
+	if move {
+		resultName = "moved"
+	}
+	ctx.response["exists"] = node != nil
+	ctx.response[resultName] = false
+	if node == nil {
+		return
+	}
+
+	// the source node can't be removed without its children
+	if move && !tree {
+		var children map[string]json.RawMessage
+		if raw, hasChildren := node["children"]; hasChildren {
+			if err = json.Unmarshal(raw, &children); err != nil {
+				return
+			}
+		}
+		if len(children) > 0 {
+			err = errors.New("the source key has children; use --tree to move them too")
+			return
+		}
+	}
+
+	if _, destExists := destTs.LocateKey(destSk); destExists && !oflag {
+		return
+	}
+
+	if !tree {
+		if err = omitExportedFields(node, []string{"children"}, false); err != nil {
+			return
+		}
+	}
+	jsonData, err := json.Marshal(node)
+	if err != nil {
+		return
+	}
+
+	if err = destTs.Import(destSk, jsonData); err != nil {
+		return
+	}
+	ctx.modifiedDb(toDb, destTs, []string{"import", string(dk), base64.StdEncoding.EncodeToString(jsonData), "--base64"}, dk)
+
+	if move {
+		if tree {
+			srcTs.DeleteKeyTree(srcSk)
+			ctx.modifiedDb(fromDb, srcTs, []string{"deltree", string(sk)}, sk)
+		} else {
+			srcTs.DeleteKey(srcSk)
+			ctx.modifiedDb(fromDb, srcTs, []string{"delk", string(sk)}, sk)
+		}
+	}
+
+	ctx.response[resultName] = true
 	return
 }
 
 func fnPurgeDatabase(args cmdline.Values) (err error) {
 	ctx := args[""].(*cmdContext)
 	ctx.cs.ts.Purge()
-	ctx.cs.tss.dirty.Add(1)
+	ctx.modified("")
 	return
 }
 
@@ -1393,3 +1701,914 @@ func fnGetAutoLinkDefinition(args cmdline.Values) (err error) {
 
 	return
 }
+
+func fnSelectDb(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	name := args["name"].(string)
+	create := args["--create"].(bool)
+
+	if create {
+		if err = validateDbName(name); err != nil {
+			return
+		}
+	}
+
+	prior, valid := ctx.cs.selectDb(name, create)
+	if !valid {
+		err = fmt.Errorf("database %s does not exist", name)
+		return
+	}
+
+	ctx.response["prior"] = prior
+	return
+}
+
+func fnListDbs(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+
+	selected, _ := ctx.cs.getSelectedDb()
+	tsu, _ := ctx.cs.tss.getUser(ctx.cs.getUser())
+
+	names := ctx.cs.tss.dbNames()
+	dbs := make([]dbInfoJson, 0, len(names))
+	for _, name := range names {
+		if tsu != nil && !tsu.allowsDatabase(name) {
+			continue
+		}
+
+		ts, exists := ctx.cs.tss.getDb(ctx.l, name, false)
+		if !exists {
+			continue
+		}
+
+		keys, values := ctx.cs.tss.keyCounts(name, ts)
+		info := dbInfoJson{
+			Name:     name,
+			Keys:     keys,
+			Values:   values,
+			Selected: name == selected,
+		}
+		info.Path, info.Size = ctx.cs.tss.dbFile(name)
+		dbs = append(dbs, info)
+	}
+
+	ctx.response["databases"] = dbs
+	return
+}
+
+func fnDropDb(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	name := args["name"].(string)
+
+	// exec holds the transaction lock that dropping a database needs
+	if ctx.inTransaction() {
+		err = errors.New("dropdb can't be used in a transaction")
+		return
+	}
+
+	if err = ctx.cs.tss.dropDb(ctx.l, name); err != nil {
+		return
+	}
+
+	ctx.response["dropped"] = true
+	return
+}
+
+func fnFlushAll(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+
+	if ctx.inTransaction() {
+		err = errors.New("flushall can't be used in a transaction")
+		return
+	}
+
+	dropped, err := ctx.cs.tss.flushAll(ctx.l)
+	if err != nil {
+		return
+	}
+
+	ctx.response["dropped"] = dropped
+	return
+}
+
+func fnCopyDb(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	src := args["src"].(string)
+	dest := args["dest"].(string)
+	overwrite := args["--overwrite"].(bool)
+
+	if ctx.inTransaction() {
+		err = errors.New("copydb can't be used in a transaction")
+		return
+	}
+
+	if err = ctx.cs.tss.copyDb(ctx.l, src, dest, overwrite); err != nil {
+		return
+	}
+
+	ctx.response["copied"] = true
+	return
+}
+
+func fnRenameDb(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	src := args["src"].(string)
+	dest := args["dest"].(string)
+
+	if ctx.inTransaction() {
+		err = errors.New("renamedb can't be used in a transaction")
+		return
+	}
+
+	if err = ctx.cs.tss.renameDb(ctx.l, src, dest); err != nil {
+		return
+	}
+
+	ctx.response["renamed"] = true
+	return
+}
+
+var errNotPersisted = errors.New("the server is not configured with a persist path")
+
+func fnSave(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+
+	if ctx.cs.tss.basePath == "" {
+		err = errNotPersisted
+		return
+	}
+
+	// exec holds the transaction lock that a save can need
+	if ctx.inTransaction() {
+		err = errors.New("save can't be used in a transaction; use bgsave")
+		return
+	}
+
+	if err = ctx.cs.tss.save(ctx.l); err != nil {
+		return
+	}
+
+	ctx.response["saved"] = true
+	return
+}
+
+func fnBgSave(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+
+	if ctx.cs.tss.basePath == "" {
+		err = errNotPersisted
+		return
+	}
+
+	if !ctx.cs.tss.bgsave(ctx.l) {
+		err = errors.New("a save is already in progress")
+		return
+	}
+
+	ctx.response["started"] = true
+	return
+}
+
+func fnLastSave(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+
+	stats := ctx.cs.tss.lastSaveStats()
+	if stats.completed.IsZero() {
+		ctx.response["timestamp"] = 0
+	} else {
+		ctx.response["timestamp"] = stats.completed.Unix()
+	}
+	ctx.response["duration_ms"] = stats.duration.Milliseconds()
+	ctx.response["dbs"] = stats.dbs
+	ctx.response["bytes"] = stats.bytes
+	return
+}
+
+func fnBackup(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+
+	// exec holds the transaction lock that a backup needs
+	if ctx.inTransaction() {
+		err = errors.New("backup can't be used in a transaction")
+		return
+	}
+
+	dir, err := ctx.cs.tss.backupDir(args["dir"].(string))
+	if err != nil {
+		return
+	}
+
+	manifest, err := ctx.cs.tss.backup(ctx.l, dir)
+	if err != nil {
+		return
+	}
+
+	var size int64
+	for _, record := range manifest.Databases {
+		size += record.Size
+	}
+	ctx.response["databases"] = len(manifest.Databases)
+	ctx.response["bytes"] = size
+	return
+}
+
+func fnRestore(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+
+	// exec holds the transaction lock that a restore needs
+	if ctx.inTransaction() {
+		err = errors.New("restore can't be used in a transaction")
+		return
+	}
+
+	dir, err := ctx.cs.tss.backupDir(args["dir"].(string))
+	if err != nil {
+		return
+	}
+
+	manifest, err := ctx.cs.tss.restore(ctx.l, dir)
+	if err != nil {
+		return
+	}
+
+	ctx.response["databases"] = len(manifest.Databases)
+	ctx.response["created"] = manifest.Started.Unix()
+	return
+}
+
+type (
+	// configParam is a server setting that can be changed at runtime
+	configParam struct {
+		get func(tss *treeStoreSet) string
+		set func(tss *treeStoreSet, value string) error
+	}
+)
+
+var configParams = map[string]configParam{
+	"save": {
+		get: func(tss *treeStoreSet) string {
+			return formatSaveRules(tss.getSaveRules())
+		},
+		set: func(tss *treeStoreSet, value string) error {
+			rules, err := parseSaveRules(value)
+			if err != nil {
+				return err
+			}
+			tss.setSaveRules(rules)
+			return nil
+		},
+	},
+}
+
+// info sections, each of which makes its metrics
+var infoSections = map[string]func(ctx *cmdContext) map[string]any{
+	"server": func(ctx *cmdContext) map[string]any {
+		return map[string]any{
+			"address":        ctx.cd.serverAddr,
+			"app_version":    ctx.cs.tss.appVersion,
+			"started":        ctx.cd.started.Unix(),
+			"uptime_seconds": int64(time.Since(ctx.cd.started).Seconds()),
+		}
+	},
+	"clients": func(ctx *cmdContext) map[string]any {
+		connected := 0
+		processConnectedClients(func(id int64, cs *clientState) {
+			if cs.tss == ctx.cs.tss {
+				connected++
+			}
+		})
+		return map[string]any{
+			"connected": connected,
+		}
+	},
+	"stats": func(ctx *cmdContext) map[string]any {
+		return map[string]any{
+			"commands_processed": ctx.cd.commands.Load(),
+		}
+	},
+	"persistence": func(ctx *cmdContext) map[string]any {
+		tss := ctx.cs.tss
+		stats := tss.lastSaveStats()
+		section := map[string]any{
+			"enabled":         tss.basePath != "",
+			"write_log":       tss.wlog.Load() != nil,
+			"save":            formatSaveRules(tss.getSaveRules()),
+			"last_save":       int64(0),
+			"last_save_ms":    stats.duration.Milliseconds(),
+			"last_save_dbs":   stats.dbs,
+			"last_save_bytes": stats.bytes,
+			"last_save_error": "",
+			"pending_changes": tss.pendingChanges(),
+			"dirty_databases": len(tss.dirtyDbs()),
+		}
+		if !stats.completed.IsZero() {
+			section["last_save"] = stats.completed.Unix()
+		}
+		if saveErr := tss.lastSaveError(); saveErr != nil {
+			section["last_save_error"] = saveErr.Error()
+		}
+		return section
+	},
+	"databases": func(ctx *cmdContext) map[string]any {
+		tss := ctx.cs.tss
+		dirty := tss.dirtyDbs()
+		section := map[string]any{}
+		for _, name := range tss.dbNames() {
+			ts, exists := tss.getDb(ctx.l, name, false)
+			if !exists {
+				continue
+			}
+			keys, values := tss.keyCounts(name, ts)
+			section[name] = map[string]any{
+				"keys":            keys,
+				"values":          values,
+				"pending_changes": dirty[name],
+			}
+		}
+		return section
+	},
+}
+
+func fnInfo(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	name, specified := args["section"].(string)
+
+	if !specified || name == "" {
+		for sectionName, section := range infoSections {
+			ctx.response[sectionName] = section(ctx)
+		}
+		return
+	}
+
+	section, exists := infoSections[name]
+	if !exists {
+		err = fmt.Errorf("unknown info section %s", name)
+		return
+	}
+	ctx.response[name] = section(ctx)
+	return
+}
+
+func fnConfigGet(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	name := args["name"].(string)
+
+	config := map[string]string{}
+	if name == "*" {
+		for paramName, param := range configParams {
+			config[paramName] = param.get(ctx.cs.tss)
+		}
+	} else {
+		param, exists := configParams[name]
+		if !exists {
+			err = fmt.Errorf("unknown setting %s", name)
+			return
+		}
+		config[name] = param.get(ctx.cs.tss)
+	}
+
+	ctx.response["config"] = config
+	return
+}
+
+func fnConfigSet(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	name := args["name"].(string)
+	value := args["value"].(string)
+
+	param, exists := configParams[name]
+	if !exists {
+		err = fmt.Errorf("unknown setting %s", name)
+		return
+	}
+
+	if err = param.set(ctx.cs.tss, value); err != nil {
+		return
+	}
+
+	ctx.response["value"] = param.get(ctx.cs.tss)
+	return
+}
+
+func fnMulti(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	err = ctx.cs.beginMulti()
+	return
+}
+
+func fnExec(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+
+	queue, err := ctx.cs.endMulti()
+	if err != nil {
+		return
+	}
+
+	// hold the transaction lock exclusively so that no other client can
+	// observe a partially applied queue
+	ctx.cs.tss.txMu.Lock()
+	defer ctx.cs.tss.txMu.Unlock()
+
+	changed := ctx.cs.watchesChanged()
+	ctx.cs.unwatchAll()
+	if changed {
+		err = errWatchedKeyChanged
+		return
+	}
+
+	results := make([]map[string]any, 0, len(queue))
+	for _, qctx := range queue {
+		qctx.inExec = true
+
+		// permissions are checked again because a queued select can
+		// change the database
+		qerr := ctx.cd.checkPermission(qctx.cs, qctx.req)
+		if qerr == nil {
+			qerr = ctx.cd.cmdLine.ProcessWithContext(qctx, qctx.req.args)
+		}
+		if qerr != nil {
+			qctx.response["error"] = qerr.Error()
+		}
+		results = append(results, qctx.response)
+	}
+
+	ctx.response["results"] = results
+	return
+}
+
+func fnDiscard(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+
+	queue, err := ctx.cs.endMulti()
+	if err != nil {
+		return
+	}
+
+	ctx.cs.unwatchAll()
+	ctx.response["discarded"] = len(queue)
+	return
+}
+
+func fnWatch(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	keys := []string{args["key"].(string)}
+	if otherKeys, specified := args["otherkeys"].([]string); specified {
+		keys = append(keys, otherKeys...)
+	}
+
+	if ctx.cs.isMultiInProgress() {
+		err = errors.New("watch is not allowed inside multi")
+		return
+	}
+
+	for _, key := range keys {
+		ctx.cs.watch(treestore.TokenPath(key))
+	}
+	return
+}
+
+func fnUnwatch(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	ctx.cs.unwatchAll()
+	return
+}
+
+// Blocks the client until ready returns true, the timeout expires, or the
+// client is unblocked with an error. A timeout of zero waits indefinitely.
+// Inside exec, ready is only checked once, because other clients cannot
+// make changes while the transaction holds its lock.
+//
+// Blocking commands run without the transaction lock, so the selected
+// database can be replaced while the client waits. Each check is made on
+// the data store selected at that time.
+func waitForKey(ctx *cmdContext, key treestore.TokenPath, timeoutMs int, ready func(ts *treestore.TreeStore) bool) (isReady bool, err error) {
+	_, ts := ctx.cs.getSelectedDb()
+	if isReady = ready(ts); isReady || ctx.inExec {
+		return
+	}
+
+	var timeout <-chan time.Time
+	if timeoutMs > 0 {
+		timer := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		_, ts = ctx.cs.getSelectedDb()
+		wk := watchKey{ts: ts, key: strings.TrimSuffix(string(key), "/")}
+
+		unblockCh := ctx.cs.capture()
+		ctx.cs.tss.addWaiter(ctx.cs, wk)
+
+		// check again after registering, in case the change raced the capture
+		isReady = ready(ts)
+
+		var reason unblockReason
+		timedOut := false
+		if !isReady {
+			select {
+			case reason = <-unblockCh:
+			case <-timeout:
+				timedOut = true
+			}
+		}
+
+		ctx.cs.tss.removeWaiter(ctx.cs)
+		ctx.cs.releaseCapture()
+
+		if isReady || timedOut {
+			return
+		}
+		if reason.isError {
+			err = errors.New(reason.reason)
+			return
+		}
+	}
+}
+
+func fnWaitKey(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	key := treestore.TokenPath(args["key"].(string))
+	timeoutMs := args["timeout"].(int)
+	sk := treestore.MakeStoreKeyFromPath(key)
+
+	var address treestore.StoreAddress
+	exists, err := waitForKey(ctx, key, timeoutMs, func(ts *treestore.TreeStore) (exists bool) {
+		address, exists = ts.LocateKey(sk)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	ctx.response["exists"] = exists
+	if exists {
+		ctx.response["address"] = address
+	}
+	return
+}
+
+func fnWaitValue(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	key := treestore.TokenPath(args["key"].(string))
+	timeoutMs := args["timeout"].(int)
+	sk := treestore.MakeStoreKeyFromPath(key)
+
+	// the value is compared in its wire form
+	_, ts := ctx.cs.getSelectedDb()
+	var baseline []byte
+	if args["--since"].(bool) {
+		var since int64
+		if since, err = strconv.ParseInt(args["since"].(string), 10, 64); err != nil {
+			return
+		}
+		if since < 0 {
+			since += time.Now().UnixNano()
+		}
+		if val, exists := ts.GetKeyValueAtTime(sk, since); exists {
+			if baseline, err = valueSignature(val); err != nil {
+				return
+			}
+		}
+	} else {
+		if val, _, exists := ts.GetKeyValue(sk); exists {
+			if baseline, err = valueSignature(val); err != nil {
+				return
+			}
+		}
+	}
+
+	var current any
+	var currentExists bool
+	changed, err := waitForKey(ctx, key, timeoutMs, func(ts *treestore.TreeStore) bool {
+		current, _, currentExists = ts.GetKeyValue(sk)
+		var sig []byte
+		if currentExists {
+			sig, _ = valueSignature(current)
+		}
+		return !bytes.Equal(sig, baseline)
+	})
+	if err != nil {
+		return
+	}
+
+	ctx.response["changed"] = changed
+	if changed && currentExists {
+		if err = addValueToResponse(ctx, current, ""); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Makes a comparable form of a value, distinguishing a nil value from
+// a missing value (nil signature).
+func valueSignature(val any) (sig []byte, err error) {
+	ev, et, err := nativeValueToCmdLine(val)
+	if err != nil {
+		return
+	}
+	sig = []byte(et + ":" + ev)
+	return
+}
+
+func fnBlockingPop(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	key := treestore.TokenPath(args["parentkey"].(string))
+	timeoutMs := args["timeout"].(int)
+	parentSk := treestore.MakeStoreKeyFromPath(key)
+
+	var childSk treestore.StoreKey
+	var jsonData []byte
+	var popErr error
+	popped, err := waitForKey(ctx, key, timeoutMs, func(_ *treestore.TreeStore) bool {
+		// pop exclusively so that competing clients take different children;
+		// exec already holds the lock
+		if !ctx.inExec {
+			ctx.cs.tss.txMu.Lock()
+			defer ctx.cs.tss.txMu.Unlock()
+		}
+
+		// the selection can't be replaced while the lock is held
+		index, ts := ctx.cs.getSelectedDb()
+
+		var found bool
+		if childSk, found = lowestChildKey(ts, parentSk); !found {
+			return false
+		}
+
+		if jsonData, popErr = ts.GetKeyAsJson(childSk, 0); popErr != nil {
+			return true
+		}
+
+		// the pop is logged as its effect, because a replayed pop would
+		// take whichever child is lowest at the time, and must not wait
+		ts.DeleteKeyTree(childSk)
+		ctx.modifiedDb(index, ts, []string{"deltree", string(childSk.Path)}, childSk.Path)
+		return true
+	})
+	if err != nil {
+		return
+	}
+	if popErr != nil {
+		err = popErr
+		return
+	}
+
+	ctx.response["popped"] = popped
+	if popped {
+		var payload any
+		if err = json.Unmarshal(jsonData, &payload); err != nil {
+			return
+		}
+
+		ctx.response["key"] = childSk.Path
+		ctx.response["data"] = payload
+	}
+	return
+}
+
+// Finds the lowest child of a key. Children with numeric names, such as
+// stagejson temporary keys, are ordered numerically ahead of other names.
+func lowestChildKey(ts *treestore.TreeStore, parentSk treestore.StoreKey) (childSk treestore.StoreKey, found bool) {
+	const pageSize = 1000
+
+	var lowest treestore.TokenSegment
+	var lowestNum uint64
+	lowestIsNum := false
+
+	// GetLevelKeys allocates the limit up front, so children are scanned in pages
+	for startAt := 0; ; startAt += pageSize {
+		children := ts.GetLevelKeys(parentSk, "*", startAt, pageSize)
+		for _, child := range children {
+			num, isNum := segmentNumber(child.Segment)
+			if !found || (isNum && (!lowestIsNum || num < lowestNum)) {
+				lowest = child.Segment
+				lowestNum = num
+				lowestIsNum = isNum
+				found = true
+			}
+		}
+		if len(children) < pageSize {
+			break
+		}
+	}
+
+	if found {
+		childSk = treestore.AppendStoreKeySegments(parentSk, lowest)
+	}
+	return
+}
+
+func segmentNumber(segment treestore.TokenSegment) (num uint64, isNum bool) {
+	num, err := strconv.ParseUint(string(segment), 10, 64)
+	isNum = (err == nil)
+	return
+}
+
+func fnClientList(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+
+	list := []map[string]string{}
+	processConnectedClients(func(id int64, cs *clientState) {
+		info := map[string]string{}
+		for _, field := range cs.client.ClientInfo() {
+			k, v, _ := strings.Cut(field, "=")
+			info[k] = v
+		}
+		list = append(list, info)
+	})
+
+	sort.Slice(list, func(i, j int) bool {
+		idI, _ := strconv.ParseInt(list[i]["id"], 10, 64)
+		idJ, _ := strconv.ParseInt(list[j]["id"], 10, 64)
+		return idI < idJ
+	})
+
+	ctx.response["clients"] = list
+	return
+}
+
+func fnClientSetName(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	name := args["name"].(string)
+
+	if strings.ContainsAny(name, " \t\r\n=") {
+		err = errors.New("client name cannot contain spaces, line breaks or '='")
+		return
+	}
+
+	ctx.cs.setName(name)
+	return
+}
+
+func fnClientGetName(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	ctx.response["name"] = ctx.cs.getName()
+	return
+}
+
+func fnClientId(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	ctx.response["id"] = ctx.cs.id
+	return
+}
+
+func fnClientKill(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+
+	filter := map[string]string{}
+	for _, field := range []string{"addr", "laddr", "id", "name"} {
+		if args["--"+field].(bool) {
+			filter[field] = args[field].(string)
+		}
+	}
+
+	if len(filter) == 0 {
+		err = errors.New("at least one filter is required")
+		return
+	}
+
+	killed := 0
+	processConnectedClients(func(id int64, cs *clientState) {
+		if cs.client.MatchFilter(filter) {
+			cs.client.RequestClose()
+			killed++
+		}
+	})
+
+	ctx.response["killed"] = killed
+	return
+}
+
+func fnAuth(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	user := args["user"].(string)
+	password := args["password"].(string)
+
+	// a user without a password cannot satisfy required authentication
+	tsu, exists := ctx.cs.tss.getUser(user)
+	if !exists || !tsu.checkPassword(password) || (ctx.cs.tss.isAuthRequired() && !tsu.hasPassword()) {
+		err = errors.New("invalid user name or password")
+		return
+	}
+
+	ctx.cs.setUser(user)
+	return
+}
+
+func fnAclSetUser(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	user := args["user"].(string)
+	password, _ := args["password"].(string)
+	noPass := args["--nopass"].(bool)
+
+	if user == "" || strings.ContainsAny(user, " \t\r\n=") {
+		err = errors.New("user name cannot be empty or contain spaces, line breaks or '='")
+		return
+	}
+	if (password != "") == noPass {
+		err = errors.New("specify either a password or --nopass")
+		return
+	}
+
+	created, err := ctx.cs.tss.setUserPassword(ctx.l, user, password, noPass)
+	if err != nil {
+		return
+	}
+
+	ctx.response["created"] = created
+	return
+}
+
+func fnAclDelUser(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	user := args["user"].(string)
+
+	existed, err := ctx.cs.tss.deleteUser(ctx.l, user)
+	if err != nil {
+		return
+	}
+
+	ctx.response["deleted"] = existed
+	if existed {
+		processAllClients(func(id int64, cs *clientState) {
+			if cs.getUser() == user {
+				cs.client.RequestClose()
+			}
+		})
+	}
+	return
+}
+
+func fnAclUsers(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	ctx.response["users"] = ctx.cs.tss.userNames()
+	return
+}
+
+func fnAclWhoAmI(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	ctx.response["user"] = ctx.cs.getUser()
+	return
+}
+
+func fnAclRequireAuth(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	required := !args["--off"].(bool)
+
+	if required {
+		// prevent a lockout by a user that cannot authenticate
+		tsu, exists := ctx.cs.tss.getUser(ctx.cs.getUser())
+		if !exists || !tsu.hasPassword() {
+			err = errors.New("the current user must have a password to require authentication")
+			return
+		}
+	}
+
+	err = ctx.cs.tss.setAuthRequired(ctx.l, required)
+	return
+}
+
+func fnAclGetUser(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	user := args["user"].(string)
+
+	perms, exists := ctx.cs.tss.getUserPermissions(user)
+	if !exists {
+		err = fmt.Errorf("user %s does not exist", user)
+		return
+	}
+
+	ctx.response["user"] = perms
+	return
+}
+
+func fnAclSetPerms(args cmdline.Values) (err error) {
+	ctx := args[""].(*cmdContext)
+	user := args["user"].(string)
+
+	// a list that isn't specified is not changed
+	lists := map[string][]string{}
+	for _, name := range []string{"categories", "databases", "keypatterns"} {
+		if list, specified := args[name].([]string); specified {
+			if len(list) == 1 && list[0] == "*" {
+				list = nil
+			}
+			lists[name] = list
+		}
+	}
+
+	if categories, specified := lists["categories"]; specified {
+		for _, category := range categories {
+			if category != cmdCategoryRead && category != cmdCategoryWrite && category != cmdCategoryAdmin {
+				err = fmt.Errorf("unrecognized command category %s", category)
+				return
+			}
+		}
+	}
+
+	err = ctx.cs.tss.setUserPermissions(ctx.l, user, lists)
+	return
+}
@@ -3,9 +3,11 @@ package treestore_cmdline
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jimsnab/go-cmdline"
@@ -21,6 +23,9 @@ type (
 		opLog         OpLogHandler
 		reqMu         sync.Mutex
 		requestNumber uint64
+		started       time.Time
+		serverAddr    string
+		commands      atomic.Uint64
 	}
 
 	OpLogHandler interface {
@@ -31,14 +36,188 @@ type (
 
 var writeCommands = map[string]struct{}{}
 
-func (cd *cmdDispatcher) registerWriteCommand(handler cmdline.CommandHandler, specList ...string) {
-	parts := strings.Split(specList[0], " ")
+var errWatchedKeyChanged = errors.New("watched key changed")
+
+// Commands that can be run before a client authenticates
+var unauthenticatedCommands = map[string]struct{}{
+	"auth": {},
+	"help": {},
+}
+
+var errAuthRequired = errors.New("authentication required")
+
+// Blocking commands are not run under the transaction lock, because they
+// can wait for a change made by another client.
+var blockingCommands = map[string]struct{}{}
+
+// Transaction commands are not queued by multi, and they are not
+// run under the shared side of the transaction lock.
+var transactionCommands = map[string]struct{}{}
+
+// Exclusive commands read and then write more than one key, so they take
+// the transaction lock exclusively to keep other clients from changing the
+// keys in between.
+var exclusiveCommands = map[string]struct{}{}
+
+// Persistence commands are not run under the transaction lock, because
+// saving a snapshot can take the lock exclusively.
+var persistenceCommands = map[string]struct{}{}
+
+// Command categories for user permissions. Connection commands are
+// always permitted.
+const (
+	cmdCategoryRead       = "read"
+	cmdCategoryWrite      = "write"
+	cmdCategoryAdmin      = "admin"
+	cmdCategoryConnection = "connection"
+)
+
+type (
+	// keyArgSpec locates a key path argument of a command for permission
+	// checking.
+	keyArgSpec struct {
+		index      int  // position in the request args
+		multi      bool // all remaining args are keys
+		relativeTo int  // if nonzero, the arg is a pattern under the key at this position
+	}
+)
+
+// command categories and key arguments, by full command name
+var commandCategories = map[string]string{}
+var commandKeyArgs = map[string][]keyArgSpec{}
+
+// argument names that hold key paths or key patterns
+var keyArgNames = map[string]struct{}{
+	"key":         {},
+	"testkey":     {},
+	"src":         {},
+	"dest":        {},
+	"pattern":     {},
+	"datakey":     {},
+	"autolinkkey": {},
+	"parentkey":   {},
+	"otherkeys":   {},
+}
+
+// options that take a key path value
+var keyOptionNames = map[string]struct{}{
+	"--ref":   {},
+	"--unref": {},
+}
+
+// commands and options that reach keys through relationship addresses,
+// which key patterns can't check; users with key restrictions can't use them
+var relationshipCommands = map[string]struct{}{
+	"follow": {},
+}
+var relationshipOptionNames = map[string]struct{}{
+	"--relationships": {},
+	"--straskey":      {},
+}
+
+// arguments that hold a password, by command name; these are masked
+// before a request is traced or passed to the op log
+var passwordArgIndexes = map[string]int{
+	"auth":        2,
+	"acl setuser": 3,
+}
+
+// options that take a database name
+var dbOptionNames = map[string]struct{}{
+	"--from-db": {},
+	"--to-db":   {},
+}
+
+func specCommandName(spec string) string {
+	parts := strings.Split(spec, " ")
 	parts = strings.Split(parts[0], "?")
-	writeCommands[parts[0]] = struct{}{}
+	return parts[0]
+}
+
+func (cd *cmdDispatcher) registerCommand(category string, handler cmdline.CommandHandler, specList ...string) {
+	primary, _, _ := strings.Cut(specList[0], "?")
+	tokens := strings.Split(primary, " ")
+	nameTokens := strings.Split(tokens[0], "+")
+	name := strings.Join(nameTokens, " ")
+
+	commandCategories[name] = category
+
+	keyArgs := []keyArgSpec{}
+	for n, token := range tokens[1:] {
+		multi := strings.Contains(token, "*<")
+		_, argName, _ := strings.Cut(token, "-")
+		argName = strings.TrimRight(argName, ">]")
+		if _, isKey := keyArgNames[argName]; isKey {
+			ka := keyArgSpec{index: len(nameTokens) + n, multi: multi}
+			if argName == "pattern" && len(keyArgs) > 0 {
+				// such as nodes <key> <pattern>
+				ka.relativeTo = keyArgs[len(keyArgs)-1].index
+			}
+			keyArgs = append(keyArgs, ka)
+		}
+	}
+	commandKeyArgs[name] = keyArgs
 
 	cd.cmdLine.RegisterCommand(handler, specList...)
 }
 
+func (cd *cmdDispatcher) registerReadCommand(handler cmdline.CommandHandler, specList ...string) {
+	cd.registerCommand(cmdCategoryRead, handler, specList...)
+}
+
+func (cd *cmdDispatcher) registerAdminCommand(handler cmdline.CommandHandler, specList ...string) {
+	cd.registerCommand(cmdCategoryAdmin, handler, specList...)
+}
+
+func (cd *cmdDispatcher) registerConnectionCommand(handler cmdline.CommandHandler, specList ...string) {
+	cd.registerCommand(cmdCategoryConnection, handler, specList...)
+}
+
+func (cd *cmdDispatcher) registerWriteCommand(handler cmdline.CommandHandler, specList ...string) {
+	writeCommands[specCommandName(specList[0])] = struct{}{}
+
+	cd.registerCommand(cmdCategoryWrite, handler, specList...)
+}
+
+func (cd *cmdDispatcher) registerExclusiveWriteCommand(handler cmdline.CommandHandler, specList ...string) {
+	writeCommands[specCommandName(specList[0])] = struct{}{}
+	exclusiveCommands[specCommandName(specList[0])] = struct{}{}
+
+	cd.registerCommand(cmdCategoryWrite, handler, specList...)
+}
+
+func (cd *cmdDispatcher) registerTransactionCommand(handler cmdline.CommandHandler, specList ...string) {
+	transactionCommands[specCommandName(specList[0])] = struct{}{}
+
+	cd.registerCommand(cmdCategoryConnection, handler, specList...)
+}
+
+func (cd *cmdDispatcher) registerPersistenceCommand(handler cmdline.CommandHandler, specList ...string) {
+	persistenceCommands[specCommandName(specList[0])] = struct{}{}
+
+	cd.registerCommand(cmdCategoryAdmin, handler, specList...)
+}
+
+func (cd *cmdDispatcher) registerPersistenceWriteCommand(handler cmdline.CommandHandler, specList ...string) {
+	writeCommands[specCommandName(specList[0])] = struct{}{}
+	persistenceCommands[specCommandName(specList[0])] = struct{}{}
+
+	cd.registerCommand(cmdCategoryAdmin, handler, specList...)
+}
+
+func (cd *cmdDispatcher) registerBlockingCommand(handler cmdline.CommandHandler, specList ...string) {
+	blockingCommands[specCommandName(specList[0])] = struct{}{}
+
+	cd.registerCommand(cmdCategoryRead, handler, specList...)
+}
+
+func (cd *cmdDispatcher) registerBlockingWriteCommand(handler cmdline.CommandHandler, specList ...string) {
+	writeCommands[specCommandName(specList[0])] = struct{}{}
+	blockingCommands[specCommandName(specList[0])] = struct{}{}
+
+	cd.registerCommand(cmdCategoryWrite, handler, specList...)
+}
+
 func newCmdDispatcher(port int, netInterface string, tss *treeStoreSet, opLog OpLogHandler) *cmdDispatcher {
 	cd := &cmdDispatcher{
 		port:    port,
@@ -46,9 +225,10 @@ func newCmdDispatcher(port int, netInterface string, tss *treeStoreSet, opLog Op
 		tss:     tss,
 		cmdLine: cmdline.NewCommandLine(),
 		opLog:   opLog,
+		started: time.Now(),
 	}
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerConnectionCommand(
 		fnHelp,
 		"help?List the available commands",
 	)
@@ -102,7 +282,7 @@ func newCmdDispatcher(port int, netInterface string, tss *treeStoreSet, opLog Op
 		"[--relationships <string-relationships>]?Associates a comma-separated list of store addresses with the key; the list can be an empty string",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnListKeys,
 		"lsk <string-pattern>?Lists keys matching the escaped key pattern",
 		"[--start <int-start>]?Zero-based starting index, default is 0",
@@ -111,7 +291,7 @@ func newCmdDispatcher(port int, netInterface string, tss *treeStoreSet, opLog Op
 		"[--detailed]?Provide each match with details of the key node such as has_children and relationships, otherwise provide a list of matching key paths",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnKeys,
 		"keys <string-pattern>?Lists leaf keys matching the escaped key pattern (alias for lsk --leaves), pattern prefix is removed from the returned list",
 		"[--start <int-start>]?Zero-based starting index, default is 0",
@@ -144,27 +324,27 @@ func newCmdDispatcher(port int, netInterface string, tss *treeStoreSet, opLog Op
 		"deltree <string-key>?Removes the key path, including its data and children",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnGetKeyTtl,
 		"ttlk <string-key>?Gets the Unix epoch timestamp in nanoseconds of when the key will expire, or 0 if it has no expiration",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnGetKeyValue,
 		"getv <string-key>?Gets value stored at the specified key path",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnGetKeyValueAtTime,
 		"vat <string-key> <string-when>?Gets value stored at the specified key path at the specified Unix nanosecond epoch (absolute timestamp if positive, relative ns if negative)",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnGetKeyValueTtl,
 		"ttlv <string-key>?For a key with a value, gets the Unix epoch timestamp in nanoseconds of when the key will expire, or 0 if it has no expiration",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnGetLevelKeys,
 		"nodes <string-key> <string-pattern>?Provides the list of key nodes that are children of key",
 		"[--start <int-start>]?Zero-based starting index, default is 0",
@@ -172,7 +352,7 @@ func newCmdDispatcher(port int, netInterface string, tss *treeStoreSet, opLog Op
 		"[--detailed]?Provide each match with details of the key node such as has_children and relationships, otherwise provide a list of matching key paths",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnListKeyValues,
 		"lsv <string-pattern>?List keys that have values and match the specified pattern",
 		"[--start <int-start>]?Zero-based starting index, default is 0",
@@ -180,22 +360,22 @@ func newCmdDispatcher(port int, netInterface string, tss *treeStoreSet, opLog Op
 		"[--detailed]?Provide each match with details of the key node such as has_children and relationships, otherwise provide a list of matching key paths",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnGetMetadataAttribute,
 		"getmeta <string-key> <string-attribute>?Get the metadata attribute value for the key",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnGetMetadataAttributes,
 		"lsmeta <string-key>?List the metadata attributes of the key",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnIsKeyIndexed,
 		"indexed <string-key>?Indicates if the specified key is indexed (because it has a current value)",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnLocateKey,
 		"getk <string-key>?Walks the treestore and returns the key's address",
 	)
@@ -225,22 +405,22 @@ func newCmdDispatcher(port int, netInterface string, tss *treeStoreSet, opLog Op
 		"setmeta <string-key> <string-attribute> <string-value>?Sets or replaces a metadata attribute value for the specified key",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnGetRelationshipValue,
 		"follow <string-key> <int-index>?Follows the relationship address at the specified key and index, returning the target key and value",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnKeyFromAddress,
 		"addrk <string-address>?Returns the key path for the specified address",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnKeyValueFromAddress,
 		"addrv <string-address>?Returns the key value for the specified address",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnExport,
 		"export <string-key>?Makes a JSON document from the tree store key",
 		"[--base64]?Export the JSON as base64",
@@ -252,7 +432,7 @@ func newCmdDispatcher(port int, netInterface string, tss *treeStoreSet, opLog Op
 		"[--base64]?The JSON string is base64",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnGetKeyJson,
 		"getjson <string-key>?Returns the key tree in JSON format",
 		"[--base64]?The JSON string is base64",
@@ -305,6 +485,32 @@ func newCmdDispatcher(port int, netInterface string, tss *treeStoreSet, opLog Op
 		"[--overwrite]?Overwrite the destination, if it exists",
 	)
 
+	cd.registerExclusiveWriteCommand(
+		fnCopyKeyTree,
+		"cpk <string-src> <string-dest>?Copies the source key and its children to the destination, with values, value types and relationships",
+		"[--overwrite]?Replace the destination key and its children, if it exists",
+		"[--with-ttl]?Copy the expiration of each key, otherwise the copies don't expire",
+		"[--with-meta]?Copy the metadata of each key",
+	)
+
+	cd.registerExclusiveWriteCommand(
+		fnCopyKey,
+		"copyk <string-src> <string-dest>?Copies the source key to the destination, which can be in another database",
+		"[--from-db <string-fromdb>]?The database of the source key, default is the active database",
+		"[--to-db <string-todb>]?The database of the destination key, default is the active database",
+		"[--tree]?Copy the children of the source key too; otherwise only its value, metadata and expiration are copied",
+		"[--overwrite]?Replace the destination key and its children, if it exists",
+	)
+
+	cd.registerExclusiveWriteCommand(
+		fnMoveKeyBetweenDbs,
+		"movek <string-src> <string-dest>?Moves the source key to the destination, which can be in another database",
+		"[--from-db <string-fromdb>]?The database of the source key, default is the active database",
+		"[--to-db <string-todb>]?The database of the destination key, default is the active database",
+		"[--tree]?Move the children of the source key too; otherwise only its value, metadata and expiration are moved, and a key with children is not moved",
+		"[--overwrite]?Replace the destination key and its children, if it exists",
+	)
+
 	cd.registerWriteCommand(
 		fnMoveReferencedKey,
 		"mvref <string-src> <string-dest>?Moves the source key to the destination in an atomic operation",
@@ -332,11 +538,203 @@ func newCmdDispatcher(port int, netInterface string, tss *treeStoreSet, opLog Op
 		"rmautolink <string-datakey> <string-autolinkkey>?Removes the auto-link key <autolinkkey> from <datakey>, and deletes the links.",
 	)
 
-	cd.cmdLine.RegisterCommand(
+	cd.registerReadCommand(
 		fnGetAutoLinkDefinition,
 		"getautolink <string-datakey>?Retrieves the auto-link definition stored in <datakey>, if one exists.",
 	)
 
+	cd.registerReadCommand(
+		fnSelectDb,
+		"select <string-name>?Selects the database used by subsequent commands of this client",
+		"[--create]?Creates the database if it does not exist; names are letters, digits, '-' and '_'",
+	)
+
+	cd.registerReadCommand(
+		fnListDbs,
+		"dbs?Lists the databases with the number of keys in each, and the path and size of each database file",
+	)
+
+	cd.registerPersistenceWriteCommand(
+		fnDropDb,
+		"dropdb <string-name>?Removes the database <name> and its file; clients using it are moved to main",
+		"--destructive?Required flag to provide a speed bump on this easy way to lose data",
+	)
+
+	cd.registerPersistenceWriteCommand(
+		fnFlushAll,
+		"flushall?Removes every database other than main, and discards all the data in main",
+		"--destructive?Required flag to provide a speed bump on this easy way to lose data",
+	)
+
+	cd.registerPersistenceWriteCommand(
+		fnCopyDb,
+		"copydb <string-src> <string-dest>?Copies the entire database <src> to a new database <dest>",
+		"[--overwrite]?Replaces <dest> if it exists",
+	)
+
+	cd.registerPersistenceWriteCommand(
+		fnRenameDb,
+		"renamedb <string-src> <string-dest>?Renames the database <src> to <dest>, which must not exist; clients using <src> follow it",
+	)
+
+	cd.registerPersistenceCommand(
+		fnSave,
+		"save?Saves the modified databases now, returning when the save is complete",
+	)
+
+	cd.registerPersistenceCommand(
+		fnBgSave,
+		"bgsave?Starts saving the modified databases in the background",
+	)
+
+	cd.registerPersistenceCommand(
+		fnLastSave,
+		"lastsave?Returns the time, duration and size of the last successful save",
+	)
+
+	cd.registerPersistenceCommand(
+		fnBackup,
+		"backup <string-dir>?Writes a copy of every database and a manifest to <dir>, a subdirectory of the server's backup path; users are not included",
+	)
+
+	cd.registerPersistenceWriteCommand(
+		fnRestore,
+		"restore <string-dir>?Replaces every database with those of the backup in <dir>, a subdirectory of the server's backup path; users are left unchanged",
+	)
+
+	cd.registerAdminCommand(
+		fnInfo,
+		"info [<string-section>]?Reports server metrics; <section> is server, clients, stats, persistence or databases, default is all",
+	)
+
+	cd.registerAdminCommand(
+		fnConfigGet,
+		"config+get <string-name>?Returns the value of a server setting; * returns all settings",
+	)
+
+	cd.registerAdminCommand(
+		fnConfigSet,
+		"config+set <string-name> <string-value>?Changes a server setting; save is pairs of <seconds> <changes>, or empty to disable periodic saves",
+	)
+
+	cd.registerTransactionCommand(
+		fnMulti,
+		"multi?Starts a transaction; subsequent commands are queued until exec or discard",
+	)
+
+	cd.registerTransactionCommand(
+		fnExec,
+		"exec?Atomically runs the commands queued since multi and returns their responses",
+	)
+
+	cd.registerTransactionCommand(
+		fnDiscard,
+		"discard?Ends a transaction, discarding the commands queued since multi",
+	)
+
+	cd.registerTransactionCommand(
+		fnWatch,
+		"watch <string-key> [*<string-otherkeys>]?Watches the keys, so that a following exec or write command fails if any of the keys (or their subkeys) change",
+	)
+
+	cd.registerTransactionCommand(
+		fnUnwatch,
+		"unwatch?Removes all watches",
+	)
+
+	cd.registerBlockingCommand(
+		fnWaitKey,
+		"waitk <string-key>?Waits for the key to exist, returning its address",
+		"[--timeout <int-timeout>]?Maximum milliseconds to wait; if not specified, waits indefinitely",
+	)
+
+	cd.registerBlockingCommand(
+		fnWaitValue,
+		"waitv <string-key>?Waits for the value of the key to change, returning the new value",
+		"[--timeout <int-timeout>]?Maximum milliseconds to wait; if not specified, waits indefinitely",
+		"[--since <string-since>]?Unix epoch nanoseconds (if positive) or relative nanoseconds (if negative) of the value to compare; returns immediately if the value changed since then",
+	)
+
+	cd.registerBlockingWriteCommand(
+		fnBlockingPop,
+		"bpop <string-parentkey>?Removes and returns the lowest child key of parentkey (such as a key made by stagejson), waiting for one if parentkey has no children",
+		"[--timeout <int-timeout>]?Maximum milliseconds to wait; if not specified, waits indefinitely",
+	)
+
+	cd.registerAdminCommand(
+		fnClientList,
+		"client+list?Lists the connected clients",
+	)
+
+	cd.registerConnectionCommand(
+		fnClientSetName,
+		"client+setname <string-name>?Assigns a name to this client connection",
+	)
+
+	cd.registerConnectionCommand(
+		fnClientGetName,
+		"client+getname?Returns the name of this client connection",
+	)
+
+	cd.registerConnectionCommand(
+		fnClientId,
+		"client+id?Returns the id of this client connection",
+	)
+
+	cd.registerAdminCommand(
+		fnClientKill,
+		"client+kill?Closes the client connections that match all of the specified filters",
+		"[--addr <string-addr>]?Matches the client address (ip:port)",
+		"[--laddr <string-laddr>]?Matches the server address (ip:port) of the connection",
+		"[--id <string-id>]?Matches the client id",
+		"[--name <string-name>]?Matches the client name",
+	)
+
+	cd.registerConnectionCommand(
+		fnAuth,
+		"auth <string-user> <string-password>?Authenticates this client connection as the specified user",
+	)
+
+	cd.registerAdminCommand(
+		fnAclSetUser,
+		"acl+setuser <string-user> [<string-password>]?Creates a user, or changes the password of an existing user",
+		"[--nopass]?Removes the user's password instead, allowing authentication with any password while authentication is not required",
+	)
+
+	cd.registerAdminCommand(
+		fnAclDelUser,
+		"acl+deluser <string-user>?Deletes a user and closes the connections authenticated as the user",
+	)
+
+	cd.registerAdminCommand(
+		fnAclUsers,
+		"acl+users?Lists the user names",
+	)
+
+	cd.registerConnectionCommand(
+		fnAclWhoAmI,
+		"acl+whoami?Returns the user name of this client connection",
+	)
+
+	cd.registerAdminCommand(
+		fnAclGetUser,
+		"acl+getuser <string-user>?Returns the permissions of a user",
+	)
+
+	cd.registerAdminCommand(
+		fnAclSetPerms,
+		"acl+setperms <string-user>?Replaces the specified permission lists of a user; a list containing only * is unrestricted",
+		"*[--category <string-categories>]?Allowed command category: read, write or admin (multiple --category args are supported)",
+		"*[--db <string-databases>]?Allowed database name (multiple --db args are supported)",
+		"*[--keypattern <string-keypatterns>]?Allowed key pattern, such as /reports/** (multiple --keypattern args are supported); a user with key patterns can't use follow, --relationships or --straskey",
+	)
+
+	cd.registerAdminCommand(
+		fnAclRequireAuth,
+		"acl+requireauth?Enables or disables the requirement for new connections to authenticate",
+		"[--off]?Disables the requirement; otherwise it is enabled, which requires this client's user to have a password",
+	)
+
 	return cd
 }
 
@@ -349,11 +747,13 @@ func (cd *cmdDispatcher) dispatchHandler(l lane.Lane, cs *clientState, req rawRe
 		req:      req,
 	}
 
+	exact := redactPasswords(req)
+
 	ll := l.SetLogLevel(lane.LogLevelError)
 	l.SetLogLevel(ll)
 	if ll >= lane.LogLevelTrace {
 		var printable strings.Builder
-		for _, param := range req.exact {
+		for _, param := range exact {
 			var sb strings.Builder
 			for _, by := range param {
 				if by == '\n' {
@@ -385,18 +785,63 @@ func (cd *cmdDispatcher) dispatchHandler(l lane.Lane, cs *clientState, req rawRe
 	}
 	cd.requestNumber = reqNumber
 	cd.reqMu.Unlock()
+	cd.commands.Add(1)
 
 	modify := false
+	isTxCommand := false
+	isBlocking := false
+	isPersistence := false
+	isExclusive := false
+	if len(req.args) > 0 {
+		_, modify = writeCommands[req.args[0]]
+		_, isTxCommand = transactionCommands[req.args[0]]
+		_, isBlocking = blockingCommands[req.args[0]]
+		_, isPersistence = persistenceCommands[req.args[0]]
+		_, isExclusive = exclusiveCommands[req.args[0]]
+	}
+
 	if cd.opLog != nil {
-		if len(req.args) > 0 {
-			_, modify = writeCommands[req.args[0]]
-		}
-		cd.opLog.OpLogRequest(reqNumber, modify, req.exact)
+		cd.opLog.OpLogRequest(reqNumber, modify, exact)
+	}
+
+	if len(req.args) > 0 {
+		cs.commandStarted(req.args[0])
+	}
+
+	isAuthenticated := cs.getUser() != ""
+	if !isAuthenticated && len(req.args) > 0 {
+		_, isAuthenticated = unauthenticatedCommands[req.args[0]]
 	}
 
-	if err = cd.cmdLine.ProcessWithContext(ctx, req.args); err != nil {
+	if !isAuthenticated {
+		err = errAuthRequired
+	} else if err = cd.checkPermission(cs, req); err != nil {
+		// denied
+	} else if isTxCommand {
+		err = cd.cmdLine.ProcessWithContext(ctx, req.args)
+	} else if cs.queueIfMulti(ctx) {
+		ctx.response["queued"] = true
+	} else if isBlocking || isPersistence {
+		err = cd.cmdLine.ProcessWithContext(ctx, req.args)
+	} else if modify && cs.hasWatches() {
+		err = cd.processWatchedWrite(ctx)
+	} else if modify && (cd.tss.wlog.Load() != nil || isExclusive) {
+		// logged writes are applied one at a time, so that the log order
+		// is the order the writes were applied
+		cd.tss.txMu.Lock()
+		err = cd.cmdLine.ProcessWithContext(ctx, req.args)
+		cd.tss.txMu.Unlock()
+	} else {
+		// ordinary commands share the transaction lock, so that exec
+		// can apply its queue without other clients interleaving
+		cd.tss.txMu.RLock()
+		err = cd.cmdLine.ProcessWithContext(ctx, req.args)
+		cd.tss.txMu.RUnlock()
+	}
+	if err != nil {
 		ctx.response["error"] = err.Error()
 	}
+	cs.commandCompleted()
 
 	// can't use json.Marshal because it imposes some HTML safeguards that are not relevant to json
 	buffer := &bytes.Buffer{}
@@ -420,3 +865,139 @@ func (cd *cmdDispatcher) dispatchHandler(l lane.Lane, cs *clientState, req rawRe
 
 	return
 }
+
+// Returns the request arguments with any password replaced by a mask, so
+// that credentials are not exposed in logs.
+func redactPasswords(req rawRequest) [][]byte {
+	index, hasPassword := passwordArgIndexes[requestCommandName(req.args)]
+	if !hasPassword || index >= len(req.exact) {
+		return req.exact
+	}
+
+	exact := make([][]byte, len(req.exact))
+	copy(exact, req.exact)
+	exact[index] = []byte("********")
+	return exact
+}
+
+// A write made by a client that has watches is conditional: it is applied
+// only if none of the watched keys changed. Either way, the watches end.
+func (cd *cmdDispatcher) processWatchedWrite(ctx *cmdContext) (err error) {
+	cd.tss.txMu.Lock()
+	defer cd.tss.txMu.Unlock()
+
+	changed := ctx.cs.watchesChanged()
+	ctx.cs.unwatchAll()
+	if changed {
+		err = errWatchedKeyChanged
+		return
+	}
+
+	return cd.cmdLine.ProcessWithContext(ctx, ctx.req.args)
+}
+
+// Returns the full name of the requested command, which can be more than
+// one token (such as "client list").
+func requestCommandName(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	if len(args) > 1 {
+		name := args[0] + " " + args[1]
+		if _, exists := commandCategories[name]; exists {
+			return name
+		}
+	}
+	return args[0]
+}
+
+// Verifies the client's user is permitted to run the request, considering
+// the command category, the selected database and the key arguments.
+func (cd *cmdDispatcher) checkPermission(cs *clientState, req rawRequest) (err error) {
+	name := requestCommandName(req.args)
+	category, exists := commandCategories[name]
+	if !exists {
+		// unrecognized commands are reported by the command line processor
+		return
+	}
+
+	// connection commands are always permitted, except watch keys are
+	// checked so that a watch cannot probe other keys
+	if category == cmdCategoryConnection && name != "watch" {
+		return
+	}
+
+	userName := cs.getUser()
+	tsu, exists := cd.tss.getUser(userName)
+	if !exists {
+		return fmt.Errorf("permission denied: user %s does not exist", userName)
+	}
+
+	if !tsu.allowsCategory(category) {
+		return fmt.Errorf("permission denied: user %s cannot run %s commands", userName, category)
+	}
+
+	if category == cmdCategoryAdmin {
+		return
+	}
+
+	// select is checked against the database it selects
+	db, _ := cs.getSelectedDb()
+	if name == "select" && len(req.args) > 1 {
+		db = req.args[1]
+	}
+	if name != "dbs" && !tsu.allowsDatabase(db) {
+		return fmt.Errorf("permission denied: user %s cannot access database %s", userName, db)
+	}
+	for n := 0; n+1 < len(req.args); n++ {
+		if _, isDbOption := dbOptionNames[req.args[n]]; isDbOption && !tsu.allowsDatabase(req.args[n+1]) {
+			return fmt.Errorf("permission denied: user %s cannot access database %s", userName, req.args[n+1])
+		}
+	}
+
+	if tsu.hasKeyRestrictions() {
+		keyArgs := commandKeyArgs[name]
+		if len(keyArgs) == 0 && category != cmdCategoryConnection {
+			// commands without key arguments operate on addresses or
+			// the entire database
+			if name != "dbs" && name != "select" {
+				return fmt.Errorf("permission denied: user %s cannot run %s because it is not key specific", userName, name)
+			}
+		}
+
+		if _, isRelationship := relationshipCommands[name]; isRelationship {
+			return fmt.Errorf("permission denied: user %s cannot run %s because it reaches keys by address", userName, name)
+		}
+		for _, arg := range req.args {
+			if _, isRelationship := relationshipOptionNames[arg]; isRelationship {
+				return fmt.Errorf("permission denied: user %s cannot use %s because it reaches keys by address", userName, arg)
+			}
+		}
+
+		keys := []string{}
+		for _, ka := range keyArgs {
+			if ka.index < len(req.args) {
+				if ka.multi {
+					keys = append(keys, req.args[ka.index:]...)
+				} else if ka.relativeTo != 0 {
+					keys = append(keys, strings.TrimRight(req.args[ka.relativeTo], "/")+"/"+req.args[ka.index])
+				} else {
+					keys = append(keys, req.args[ka.index])
+				}
+			}
+		}
+		for n := 0; n+1 < len(req.args); n++ {
+			if _, isKeyOption := keyOptionNames[req.args[n]]; isKeyOption {
+				keys = append(keys, req.args[n+1])
+			}
+		}
+
+		for _, key := range keys {
+			if !tsu.allowsKey(key) {
+				return fmt.Errorf("permission denied: user %s cannot access key %s", userName, key)
+			}
+		}
+	}
+
+	return
+}
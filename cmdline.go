@@ -2,9 +2,11 @@ package treestore_cmdline
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -25,8 +27,10 @@ type (
 		terminating     bool
 		port            int
 		iface           string
+		socketPath      string
 		dispatcher      *cmdDispatcher
 		directCs        *clientState
+		tlsReloader     *tlsCertReloader
 	}
 
 	TreeStoreCmdLineServer interface {
@@ -66,6 +70,10 @@ type (
 		// will be value-escaped.
 		StartServer(endpoint string, port int, persistPath string, appVersion int, opLog OpLogHandler) error
 
+		// Starts the server as specified by opts, such as with TLS encryption or
+		// on a Unix domain socket. StartServer is a shorthand for the defaults.
+		StartServerWithOptions(opts ServerOptions) error
+
 		// Initiates server termination, if it is running.
 		StopServer() error
 
@@ -89,6 +97,16 @@ func NewTreeStoreCmdLineServer(l lane.Lane) TreeStoreCmdLineServer {
 }
 
 func (eng *mainEngine) StartServer(endpoint string, port int, persistPath string, appVersion int, opLog OpLogHandler) error {
+	return eng.StartServerWithOptions(ServerOptions{
+		Endpoint:    endpoint,
+		Port:        port,
+		PersistPath: persistPath,
+		AppVersion:  appVersion,
+		OpLog:       opLog,
+	})
+}
+
+func (eng *mainEngine) StartServerWithOptions(opts ServerOptions) error {
 	eng.mu.Lock()
 	defer eng.mu.Unlock()
 
@@ -96,21 +114,41 @@ func (eng *mainEngine) StartServer(endpoint string, port int, persistPath string
 		return fmt.Errorf("already started")
 	}
 
-	if port != 0 {
-		eng.port = port
-	} else {
-		eng.port = 6770
+	if err := opts.validate(); err != nil {
+		return err
 	}
 
-	if endpoint != "" {
-		eng.iface = endpoint
+	var tcr *tlsCertReloader
+	if opts.Tls != nil {
+		var err error
+		if tcr, err = newTlsCertReloader(eng.l, *opts.Tls); err != nil {
+			return err
+		}
 	}
 
-	tss, err := newTreeStoreSet(eng.l, persistPath, appVersion)
+	eng.port = opts.Port
+	eng.iface = opts.Endpoint
+	eng.socketPath = opts.SocketPath
+
+	tss, err := newTreeStoreSet(eng.l, opts.PersistPath, opts.AppVersion, opts.QuarantineCorruptDbs)
 	if err != nil {
 		return err
 	}
 	eng.tss = tss
+	tss.setSaveRules(opts.SaveRules)
+	tss.backupPath = opts.BackupPath
+
+	if opts.RestorePath != "" {
+		if _, err = tss.restore(eng.l, opts.RestorePath); err != nil {
+			return err
+		}
+	}
+
+	if opts.WriteLog {
+		if err = tss.openWriteLog(eng.l, opts.WriteLogFsync); err != nil {
+			return err
+		}
+	}
 
 	// launch termination monitiors
 	eng.canExit = make(chan struct{})
@@ -119,8 +157,12 @@ func (eng *mainEngine) StartServer(endpoint string, port int, persistPath string
 	eng.periodicSave()
 
 	// start accepting connections and processing them
-	err = eng.startServer(opLog)
+	eng.tlsReloader = tcr
+	err = eng.startServer(opts.OpLog)
 	if err != nil {
+		eng.tlsReloader = nil
+		eng.stopPeriodicSave()
+		tss.closeWriteLog()
 		return err
 	}
 	eng.started = true
@@ -155,7 +197,7 @@ func (eng *mainEngine) onTerminate() {
 
 		eng.mu.Lock()
 		for _, cxn := range eng.cxns {
-			eng.l.Tracef("closing connection %s <-> %s", cxn.LocalAddr().String(), cxn.RemoteAddr().String())
+			eng.l.Tracef("closing connection %s <-> %s", addrString(cxn.LocalAddr()), addrString(cxn.RemoteAddr()))
 			cxn.Close()
 		}
 		eng.cxns = []net.Conn{}
@@ -167,15 +209,25 @@ func (eng *mainEngine) onTerminate() {
 		eng.l.Infof("termination of %s completed", eng.server.Addr().String())
 	}
 
-	// stop the periodic saver (if running)
+	eng.stopPeriodicSave()
+	eng.tss.closeWriteLog()
+
+	eng.mu.Lock()
+	eng.tlsReloader = nil
+	eng.mu.Unlock()
+
+	eng.canExit <- struct{}{}
+}
+
+// Stops the periodic saver (if running), which saves upon exit.
+func (eng *mainEngine) stopPeriodicSave() {
 	if eng.exitSaver != nil {
 		eng.l.Tracef("closing database saver")
 		eng.exitSaver <- struct{}{}
 		<-eng.saverTerminated
+		eng.exitSaver = nil
 		eng.l.Tracef("database saver closed")
 	}
-
-	eng.canExit <- struct{}{}
 }
 
 func (eng *mainEngine) periodicSave() {
@@ -184,7 +236,10 @@ func (eng *mainEngine) periodicSave() {
 		eng.exitSaver = make(chan struct{})
 		eng.saverTerminated = make(chan struct{})
 		go func() {
+			// the save rules are checked each second, so that rule changes
+			// take effect without restarting the loop
 			timer := time.NewTicker(time.Second)
+			lastSave := time.Now()
 			for {
 				select {
 				case <-eng.exitSaver:
@@ -194,7 +249,13 @@ func (eng *mainEngine) periodicSave() {
 					eng.saverTerminated <- struct{}{}
 					return
 				case <-timer.C:
-					eng.tss.save(eng.l)
+					if completed := eng.tss.lastSaveStats().completed; completed.After(lastSave) {
+						lastSave = completed
+					}
+					if saveRulesDue(eng.tss.getSaveRules(), eng.tss.pendingChanges(), time.Since(lastSave)) {
+						eng.tss.save(eng.l)
+						lastSave = time.Now()
+					}
 				}
 			}
 		}()
@@ -205,20 +266,36 @@ func (eng *mainEngine) startServer(opLog OpLogHandler) error {
 	// establish socket service
 	var err error
 
-	if eng.iface == "" {
+	network := "tcp"
+	if eng.socketPath != "" {
+		network = "unix"
+		eng.iface = eng.socketPath
+		if err = removeStaleSocket(eng.socketPath); err != nil {
+			eng.l.Errorf("error listening: %s", err.Error())
+			return err
+		}
+	} else if eng.iface == "" {
 		eng.iface = fmt.Sprintf(":%d", eng.port)
 	} else {
 		eng.iface = fmt.Sprintf("%s:%d", eng.iface, eng.port)
 	}
 
-	eng.server, err = net.Listen("tcp", eng.iface)
+	// a unix listener removes its socket file when closed
+	eng.server, err = net.Listen(network, eng.iface)
 	if err != nil {
 		eng.l.Errorf("error listening: %s", err.Error())
 		return err
 	}
-	eng.l.Infof("listening on %s", eng.server.Addr().String())
+
+	if eng.tlsReloader != nil {
+		eng.server = tls.NewListener(eng.server, eng.tlsReloader.tlsConfig())
+		eng.l.Infof("listening with TLS on %s", eng.server.Addr().String())
+	} else {
+		eng.l.Infof("listening on %s", eng.server.Addr().String())
+	}
 
 	eng.dispatcher = newCmdDispatcher(eng.port, eng.iface, eng.tss, opLog)
+	eng.dispatcher.serverAddr = eng.server.Addr().String()
 
 	directCc := &clientCxn{
 		cxn:         nil,
@@ -244,7 +321,7 @@ func (eng *mainEngine) startServer(opLog OpLogHandler) error {
 			eng.mu.Lock()
 			eng.cxns = append(eng.cxns, connection)
 			eng.mu.Unlock()
-			eng.l.Infof("client connected: %s", connection.RemoteAddr().String())
+			eng.l.Infof("client connected: %s", addrString(connection.RemoteAddr()))
 			newClientCxn(eng.l, connection, eng.dispatcher)
 		}
 	}()
@@ -291,3 +368,37 @@ func (eng *mainEngine) Dispatch(escapedArgs [][]byte) (reply []byte, err error)
 
 	return eng.dispatcher.dispatchHandler(eng.l, eng.directCs, req)
 }
+
+// Removes a socket file left behind by a server that did not shut down
+// cleanly. A socket that still accepts connections is in use and is
+// not removed.
+func removeStaleSocket(socketPath string) error {
+	fi, err := os.Lstat(socketPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", socketPath)
+	}
+
+	cxn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err == nil {
+		cxn.Close()
+		return fmt.Errorf("socket %s is in use", socketPath)
+	}
+
+	return os.Remove(socketPath)
+}
+
+// Formats a connection address, which can be nil for an unnamed unix
+// socket peer.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
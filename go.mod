@@ -8,6 +8,7 @@ require (
 	github.com/jimsnab/go-cmdline v1.6.0
 	github.com/jimsnab/go-lane v1.18.1
 	github.com/jimsnab/go-treestore v0.0.0-20240321183110-a5b905356f5b
+	golang.org/x/crypto v0.21.0
 )
 
 require (
@@ -0,0 +1,74 @@
+package treestore_cmdline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// SaveRule triggers a periodic save when at least Changes modifications
+	// are pending and Seconds have elapsed since the last save.
+	SaveRule struct {
+		Seconds int
+		Changes int
+	}
+)
+
+// The default policy saves pending changes every second.
+var defaultSaveRules = []SaveRule{{Seconds: 1, Changes: 1}}
+
+// Parses a save policy from pairs of <seconds> <changes>, such as
+// "900 1 300 10". An empty string disables periodic saves.
+func parseSaveRules(text string) (rules []SaveRule, err error) {
+	fields := strings.Fields(text)
+	if len(fields)%2 != 0 {
+		err = fmt.Errorf("save policy must be pairs of <seconds> <changes>")
+		return
+	}
+
+	rules = []SaveRule{}
+	for n := 0; n < len(fields); n += 2 {
+		var rule SaveRule
+		if rule.Seconds, err = strconv.Atoi(fields[n]); err != nil {
+			err = fmt.Errorf("invalid seconds %s", fields[n])
+			return
+		}
+		if rule.Changes, err = strconv.Atoi(fields[n+1]); err != nil {
+			err = fmt.Errorf("invalid changes %s", fields[n+1])
+			return
+		}
+		rules = append(rules, rule)
+	}
+
+	err = validateSaveRules(rules)
+	return
+}
+
+func validateSaveRules(rules []SaveRule) error {
+	for _, rule := range rules {
+		if rule.Seconds < 1 || rule.Changes < 1 {
+			return fmt.Errorf("save rule %d %d must have positive seconds and changes", rule.Seconds, rule.Changes)
+		}
+	}
+	return nil
+}
+
+func formatSaveRules(rules []SaveRule) string {
+	fields := make([]string, 0, len(rules)*2)
+	for _, rule := range rules {
+		fields = append(fields, strconv.Itoa(rule.Seconds), strconv.Itoa(rule.Changes))
+	}
+	return strings.Join(fields, " ")
+}
+
+// Determines if any rule calls for a save.
+func saveRulesDue(rules []SaveRule, changes uint64, sinceSave time.Duration) bool {
+	for _, rule := range rules {
+		if changes >= uint64(rule.Changes) && sinceSave >= time.Duration(rule.Seconds)*time.Second {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package treestore_cmdline
+
+import (
+	"errors"
+	"fmt"
+)
+
+const defaultPort = 6770
+
+type (
+	// ServerOptions specifies how StartServerWithOptions runs the server.
+	// The zero value of each field selects its default.
+	ServerOptions struct {
+		// Network interface to listen on; "" listens on all interfaces.
+		Endpoint string
+
+		// TCP port to listen on; 0 selects port 6770.
+		Port int
+
+		// If specified, the server listens on a Unix domain socket at this
+		// path instead of a TCP port. Endpoint, Port and Tls must not be set.
+		// Access to the server can be controlled with the permissions of the
+		// socket file and its directory. A stale socket file left by a prior
+		// server is removed on start, and the socket file is removed when the
+		// server stops.
+		SocketPath string
+
+		// Base file name for database persistence; "" keeps data in memory
+		// only. Each database name plus ".db" is appended to this base.
+		PersistPath string
+
+		// Application version stored with the persisted data.
+		AppVersion int
+
+		// Receives the log of store operations, if not nil.
+		OpLog OpLogHandler
+
+		// Enables TLS encryption of the TCP listener, if not nil.
+		Tls *TlsOptions
+
+		// Enables the append-only log of write requests, which is replayed
+		// on start so that writes made after the last snapshot survive a
+		// crash. Requires PersistPath.
+		WriteLog bool
+
+		// Specifies when the write log is flushed to stable storage.
+		WriteLogFsync WriteLogFsync
+
+		// Rules for periodic saves of modified databases; nil saves changes
+		// every second. The rules can be changed with "config set save".
+		SaveRules []SaveRule
+
+		// If true, modified databases are saved only upon request and when
+		// the server stops.
+		DisablePeriodicSave bool
+
+		// If specified, the databases are replaced at start with those of the
+		// backup archive in this directory, as made by the backup command.
+		RestorePath string
+
+		// Directory of the backup archives made and restored by the backup
+		// and restore commands, which name a subdirectory of it; "" disables
+		// the commands.
+		BackupPath string
+
+		// If true, a database file that fails to load at start is renamed
+		// with a ".corrupt-<time>" suffix and the server starts without it;
+		// otherwise the server does not start.
+		QuarantineCorruptDbs bool
+	}
+)
+
+// Checks the options for conflicts and fills in defaults.
+func (opts *ServerOptions) validate() error {
+	if opts.WriteLog && opts.PersistPath == "" {
+		return errors.New("the write log requires a persist path")
+	}
+	if opts.WriteLogFsync < WriteLogFsyncEverySecond || opts.WriteLogFsync > WriteLogFsyncNever {
+		return fmt.Errorf("invalid write log fsync policy %d", opts.WriteLogFsync)
+	}
+
+	if err := validateSaveRules(opts.SaveRules); err != nil {
+		return err
+	}
+	if opts.DisablePeriodicSave {
+		opts.SaveRules = []SaveRule{}
+	} else if opts.SaveRules == nil {
+		opts.SaveRules = defaultSaveRules
+	}
+
+	if opts.SocketPath != "" {
+		if opts.Endpoint != "" || opts.Port != 0 {
+			return errors.New("a socket path cannot be combined with an endpoint or port")
+		}
+		if opts.Tls != nil {
+			return errors.New("TLS is not supported on a unix socket")
+		}
+		return nil
+	}
+
+	if opts.Port < 0 || opts.Port > 65535 {
+		return fmt.Errorf("invalid port %d", opts.Port)
+	}
+	if opts.Port == 0 {
+		opts.Port = defaultPort
+	}
+	return nil
+}
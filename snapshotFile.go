@@ -0,0 +1,168 @@
+package treestore_cmdline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jimsnab/go-lane"
+	"github.com/jimsnab/go-treestore"
+)
+
+// A snapshot file is the data store content written by ts.Save, followed
+// by a trailer of:
+//
+//	<8 byte magic> <uint64 content length> <uint64 write log sequence> <uint32 content crc32>
+//
+// where the sequence is that of the last write log record included in the
+// snapshot. ts.Load stops at the end of the content, so it ignores the
+// trailer. Files saved before the trailer was introduced are loaded
+// unverified.
+var snapshotMagic = []byte("TSSNAP01")
+
+const snapshotTrailerSize = 28
+
+var errSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+// Serializes the data store to memory. ts.Save only writes to a named file,
+// so the content is saved to an unflushed temporary file and read back; the
+// data store is locked only while it is saved, and the content is written
+// to its destination by commitSnapshot.
+func captureSnapshot(l lane.Lane, ts *treestore.TreeStore) (content []byte, err error) {
+	f, err := os.CreateTemp("", "treestore-snapshot-*.db")
+	if err != nil {
+		return
+	}
+	tempName := f.Name()
+	f.Close()
+	defer os.Remove(tempName)
+
+	if err = ts.Save(l, tempName); err != nil {
+		return
+	}
+	return os.ReadFile(tempName)
+}
+
+// Writes a snapshot made by captureSnapshot so that a crash cannot leave a
+// partial file: the content and its checksum trailer are written to a
+// temporary file, flushed to stable storage, and then renamed over the
+// prior snapshot.
+func commitSnapshot(content []byte, fileName string, seq uint64) (size int64, err error) {
+	tempName := fileName + ".tmp"
+	if err = writeSnapshotFile(tempName, content, seq); err != nil {
+		os.Remove(tempName)
+		return
+	}
+
+	if err = os.Rename(tempName, fileName); err != nil {
+		os.Remove(tempName)
+		return
+	}
+
+	if err = syncDir(filepath.Dir(fileName)); err != nil {
+		return
+	}
+	size = int64(len(content)) + snapshotTrailerSize
+	return
+}
+
+func writeSnapshotFile(fileName string, content []byte, seq uint64) (err error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	trailer := make([]byte, snapshotTrailerSize)
+	copy(trailer, snapshotMagic)
+	binary.BigEndian.PutUint64(trailer[8:], uint64(len(content)))
+	binary.BigEndian.PutUint64(trailer[16:], seq)
+	binary.BigEndian.PutUint32(trailer[24:], crc32.ChecksumIEEE(content))
+
+	if _, err = f.Write(content); err != nil {
+		return
+	}
+	if _, err = f.Write(trailer); err != nil {
+		return
+	}
+	return f.Sync()
+}
+
+// Checks the snapshot content against its trailer, and returns the write
+// log sequence that it includes. A file without a trailer is accepted as a
+// snapshot from an earlier version.
+func verifySnapshot(l lane.Lane, fileName string) (seq uint64, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	size := fi.Size()
+	trailer := make([]byte, snapshotTrailerSize)
+	if size >= snapshotTrailerSize {
+		if _, err = f.ReadAt(trailer, size-snapshotTrailerSize); err != nil {
+			return
+		}
+	}
+	if size < snapshotTrailerSize || !bytes.Equal(trailer[:8], snapshotMagic) {
+		l.Warnf("%s has no checksum and is loaded unverified", fileName)
+		return
+	}
+
+	length := binary.BigEndian.Uint64(trailer[8:])
+	if length != uint64(size-snapshotTrailerSize) {
+		err = fmt.Errorf("%w: %s length is %d, expected %d", errSnapshotChecksum, fileName, size-snapshotTrailerSize, length)
+		return
+	}
+
+	hash := crc32.NewIEEE()
+	if _, err = io.Copy(hash, io.NewSectionReader(f, 0, int64(length))); err != nil {
+		return
+	}
+	if hash.Sum32() != binary.BigEndian.Uint32(trailer[24:]) {
+		err = fmt.Errorf("%w: %s", errSnapshotChecksum, fileName)
+		return
+	}
+
+	seq = binary.BigEndian.Uint64(trailer[16:])
+	return
+}
+
+// Verifies and loads a snapshot file.
+func loadSnapshot(l lane.Lane, ts *treestore.TreeStore, fileName string) (seq uint64, err error) {
+	if seq, err = verifySnapshot(l, fileName); err != nil {
+		return
+	}
+	err = ts.Load(l, fileName)
+	return
+}
+
+// Moves a snapshot that can't be loaded out of the way, so that it is
+// kept for investigation but not loaded again.
+func quarantineSnapshot(fileName string) (quarantineName string, err error) {
+	quarantineName = fmt.Sprintf("%s.corrupt-%d", fileName, time.Now().Unix())
+	err = os.Rename(fileName, quarantineName)
+	return
+}
+
+// Flushes directory entry changes, such as a rename, to stable storage.
+func syncDir(dir string) (err error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,166 @@
+package treestore_cmdline
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jimsnab/go-lane"
+)
+
+// A client that connects and doesn't complete the TLS handshake within
+// this time is disconnected.
+const tlsHandshakeTimeout = 10 * time.Second
+
+type (
+	// TlsOptions specifies the certificate files of a TLS socket server.
+	//
+	// CertFile and KeyFile are the PEM server certificate (chain) and its
+	// private key. If ClientCaFile is specified, client certificates are
+	// verified with the PEM CA bundle; RequireClientCert additionally
+	// rejects clients that do not present a certificate.
+	//
+	// The files are checked for changes at each new connection, so that
+	// certificates can be replaced without restarting the server.
+	TlsOptions struct {
+		CertFile          string
+		KeyFile           string
+		ClientCaFile      string
+		RequireClientCert bool
+	}
+
+	// tlsCertReloader provides the TLS configuration for each connection,
+	// reloading the certificate files when they change.
+	tlsCertReloader struct {
+		mu         sync.Mutex
+		l          lane.Lane
+		opts       TlsOptions
+		cert       *tls.Certificate
+		clientCas  *x509.CertPool
+		certMod    time.Time
+		keyMod     time.Time
+		caMod      time.Time
+		lastReload time.Time
+	}
+)
+
+func newTlsCertReloader(l lane.Lane, opts TlsOptions) (tcr *tlsCertReloader, err error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		err = errors.New("TLS requires a certificate file and a key file")
+		return
+	}
+	if opts.RequireClientCert && opts.ClientCaFile == "" {
+		err = errors.New("TLS client certificate verification requires a CA file")
+		return
+	}
+
+	tcr = &tlsCertReloader{
+		l:    l,
+		opts: opts,
+	}
+
+	// the initial load must succeed; subsequent reload errors keep the
+	// prior certificates
+	if err = tcr.reload(); err != nil {
+		tcr = nil
+		return
+	}
+	return
+}
+
+func (tcr *tlsCertReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: tcr.configForClient,
+	}
+}
+
+func (tcr *tlsCertReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if err := tcr.reload(); err != nil {
+		tcr.l.Errorf("TLS certificate reload failed, continuing with prior certificates: %s", err)
+	}
+
+	tcr.mu.Lock()
+	defer tcr.mu.Unlock()
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*tcr.cert},
+	}
+
+	if tcr.clientCas != nil {
+		cfg.ClientCAs = tcr.clientCas
+		if tcr.opts.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return cfg, nil
+}
+
+// Loads the certificate files if any of them changed since the last load.
+func (tcr *tlsCertReloader) reload() (err error) {
+	tcr.mu.Lock()
+	defer tcr.mu.Unlock()
+
+	certMod, err := fileModTime(tcr.opts.CertFile)
+	if err != nil {
+		return
+	}
+	keyMod, err := fileModTime(tcr.opts.KeyFile)
+	if err != nil {
+		return
+	}
+	var caMod time.Time
+	if tcr.opts.ClientCaFile != "" {
+		if caMod, err = fileModTime(tcr.opts.ClientCaFile); err != nil {
+			return
+		}
+	}
+
+	if tcr.cert != nil && certMod.Equal(tcr.certMod) && keyMod.Equal(tcr.keyMod) && caMod.Equal(tcr.caMod) {
+		return
+	}
+
+	cert, err := tls.LoadX509KeyPair(tcr.opts.CertFile, tcr.opts.KeyFile)
+	if err != nil {
+		return
+	}
+
+	var clientCas *x509.CertPool
+	if tcr.opts.ClientCaFile != "" {
+		var pem []byte
+		if pem, err = os.ReadFile(tcr.opts.ClientCaFile); err != nil {
+			return
+		}
+		clientCas = x509.NewCertPool()
+		if !clientCas.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("no certificates found in %s", tcr.opts.ClientCaFile)
+			return
+		}
+	}
+
+	tcr.cert = &cert
+	tcr.clientCas = clientCas
+	tcr.certMod = certMod
+	tcr.keyMod = keyMod
+	tcr.caMod = caMod
+	tcr.lastReload = time.Now()
+	tcr.l.Infof("loaded TLS certificate %s", tcr.opts.CertFile)
+	return
+}
+
+func fileModTime(fileName string) (modTime time.Time, err error) {
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return
+	}
+	modTime = fi.ModTime()
+	return
+}
@@ -1,71 +1,162 @@
 package treestore_cmdline
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/fs"
+	"math"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/jimsnab/go-lane"
 	"github.com/jimsnab/go-treestore"
 )
 
 type (
+	// watchedKey tracks a key that one or more clients are watching, and
+	// the version of its last modification.
+	watchedKey struct {
+		refs    int
+		version uint64
+	}
+
+	// saveStats describes the last successful save
+	saveStats struct {
+		completed time.Time
+		duration  time.Duration
+		dbs       int
+		bytes     int64
+	}
+
+	// keyCounts caches the key counts of a data store, which are counted
+	// again after the database is modified, or when the counts are old
+	// because keys can expire without a modification
+	keyCounts struct {
+		ts      *treestore.TreeStore
+		version uint64
+		counted time.Time
+		keys    int
+		values  int
+	}
+
+	// usersFile is the persisted form of the user accounts
+	usersFile struct {
+		RequireAuth bool                      `json:"require_auth"`
+		Users       map[string]*treeStoreUser `json:"users"`
+	}
+
 	treeStoreSet struct {
-		mu         sync.Mutex
-		appVersion int
-		basePath   string
-		dbs        map[string]*treestore.TreeStore
-		users      map[string]*treeStoreUser
-		dirty      atomic.Int32
+		mu          sync.Mutex
+		txMu        sync.RWMutex
+		appVersion  int
+		basePath    string
+		dbs         map[string]*treestore.TreeStore
+		users       map[string]*treeStoreUser
+		requireAuth bool
+		usersFileMu sync.Mutex
+		dirtyMu     sync.Mutex
+		dirty       map[string]uint64
+		versions    map[string]uint64
+		countsMu    sync.Mutex
+		counts      map[string]*keyCounts
+		saveMu      sync.Mutex
+		statsMu     sync.Mutex
+		lastSave    saveStats
+		lastSaveErr error
+		saveRules   []SaveRule
+		snapshotSeq map[string]uint64
+		logSeq      uint64
+		watchMu     sync.Mutex
+		watchSeq    uint64
+		watched     map[watchKey]*watchedKey
+		waiters     map[*clientState]watchKey
+		wlog        atomic.Pointer[writeLog]
+		backupPath  string
 	}
 )
 
-func newTreeStoreSet(l lane.Lane, basePath string, appVersion int) (tss *treeStoreSet, err error) {
+// Makes the set of databases, loading any persisted under basePath. If
+// quarantineCorrupt is true, a database file that fails to load is renamed
+// aside and the remaining databases are loaded; otherwise the load fails.
+func newTreeStoreSet(l lane.Lane, basePath string, appVersion int, quarantineCorrupt bool) (tss *treeStoreSet, err error) {
 	tss = &treeStoreSet{
-		basePath:   basePath,
-		appVersion: appVersion,
-		dbs:        map[string]*treestore.TreeStore{},
-		users:      map[string]*treeStoreUser{"default": newTreeStoreUser()},
+		basePath:    basePath,
+		appVersion:  appVersion,
+		dbs:         map[string]*treestore.TreeStore{},
+		dirty:       map[string]uint64{},
+		versions:    map[string]uint64{},
+		counts:      map[string]*keyCounts{},
+		snapshotSeq: map[string]uint64{},
+		saveRules:   defaultSaveRules,
+		users:       map[string]*treeStoreUser{"default": newDefaultUser()},
+		watched:     map[watchKey]*watchedKey{},
+		waiters:     map[*clientState]watchKey{},
 	}
 
 	tss.createDbUnlocked(l, "main")
 	if basePath != "" {
+		if err = tss.loadUsers(l); err != nil {
+			tss = nil
+			return
+		}
+
 		dbs := 0
 		l.Tracef("loading database(s) from base path %s", basePath)
 
-		// Search the file system for persisted data, and load each data store
+		// Data store files are <base-name>.<name>.db in the directory of
+		// basePath, where <base-name> is user provided and <name> is the
+		// data store index. Other files, and subdirectories, are ignored.
 		dir, fileBase := filepath.Split(basePath)
 		if dir == "" {
 			dir = "."
 		}
 
-		// data store files are <base-name>.<name>.db where <base-name> is user provided
-		// and <name> is the data store index.
-		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-			if !d.IsDir() {
-				if strings.HasPrefix(d.Name(), fileBase) && strings.HasSuffix(d.Name(), ".db") {
-					name := d.Name()[len(fileBase):]
-					name = strings.Trim(name, ".db")
-					if len(name) > 0 {
-						// found a data store file - load it
-						ts, _ := tss.createDbUnlocked(l, name)
-						l.Tracef("loading database %s from %s", name, path)
-						loadErr := ts.Load(l, path)
-						if loadErr != nil {
-							l.Errorf("error loading %s: %v", path, loadErr)
-							return loadErr
-						} else {
-							dbs++
-						}
-					}
+		var entries []os.DirEntry
+		if entries, err = os.ReadDir(dir); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		}
+
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			name, isDbFile := parseDbFileName(fileBase, entry.Name())
+			if !isDbFile {
+				continue
+			}
+			if nameErr := validateDbName(name); nameErr != nil {
+				l.Warnf("ignoring %s: %s", entry.Name(), nameErr)
+				continue
+			}
+
+			// found a data store file - load it
+			path := filepath.Join(dir, entry.Name())
+			ts, _ := tss.createDbUnlocked(l, name)
+			l.Tracef("loading database %s from %s", name, path)
+			seq, loadErr := loadSnapshot(l, ts, path)
+			if loadErr != nil {
+				l.Errorf("error loading %s: %v", path, loadErr)
+				if !quarantineCorrupt {
+					err = loadErr
+					break
 				}
+				if err = tss.quarantineDbUnlocked(l, name, path); err != nil {
+					break
+				}
+				continue
 			}
 
-			return nil
-		})
+			tss.snapshotSeq[name] = seq
+			tss.logSeq = max(tss.logSeq, seq)
+			dbs++
+		}
 
 		if err != nil {
 			tss = nil
@@ -73,27 +164,346 @@ func newTreeStoreSet(l lane.Lane, basePath string, appVersion int) (tss *treeSto
 		}
 
 		l.Tracef("databases loaded: %d", dbs)
+
+		if err = tss.replayWriteLog(l); err != nil {
+			tss = nil
+			return
+		}
+	}
+
+	return
+}
+
+// Applies the writes logged after the last snapshot of each database. The
+// replayed data is saved as a new snapshot right away, so that the log can
+// be discarded whether or not the server continues to keep one.
+func (tss *treeStoreSet) replayWriteLog(l lane.Lane) (err error) {
+	cd := newCmdDispatcher(0, "", tss, nil)
+	cs := &clientState{
+		l:           l,
+		tss:         tss,
+		disp:        cd,
+		user:        "default",
+		respVersion: 2,
+		unblockCh:   make(chan unblockReason, 1),
+		watches:     map[watchKey]uint64{},
 	}
 
+	fileName := tss.writeLogFileName()
+	records, err := replayWriteLog(l, fileName, func(seq uint64, index string, args []string) error {
+		tss.logSeq = max(tss.logSeq, seq)
+		if seq <= tss.snapshotSeq[index] {
+			// already included in the snapshot
+			return nil
+		}
+
+		cs.selectedDb = index
+		cs.ts, _ = tss.getDb(l, index, true)
+
+		escapedArgs := make([][]byte, 0, len(args))
+		for _, arg := range args {
+			escapedArgs = append(escapedArgs, []byte(arg))
+		}
+
+		ctx := &cmdContext{
+			l:        l,
+			response: map[string]any{},
+			cd:       cd,
+			cs:       cs,
+			req:      newRawRequest(escapedArgs),
+			inExec:   true,
+			replay:   true,
+		}
+		return cd.cmdLine.ProcessWithContext(ctx, ctx.req.args)
+	})
+	if err != nil || records == 0 {
+		return
+	}
+
+	l.Infof("replayed %d write(s) from %s", records, fileName)
+	if err = tss.save(l); err != nil {
+		return
+	}
+	return os.Remove(fileName)
+}
+
+func (tss *treeStoreSet) writeLogFileName() string {
+	if tss.basePath == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s.writelog", tss.basePath)
+}
+
+// Starts logging each write, so that writes made after the last snapshot
+// survive a crash.
+func (tss *treeStoreSet) openWriteLog(l lane.Lane, fsync WriteLogFsync) (err error) {
+	wl, err := openWriteLog(l, tss.writeLogFileName(), fsync, tss.logSeq)
+	if err != nil {
+		return
+	}
+	tss.wlog.Store(wl)
 	return
 }
 
+// Stops logging writes. Writes and saves are held off while the log is
+// closed, so that none of them uses it afterward.
+func (tss *treeStoreSet) closeWriteLog() {
+	tss.saveMu.Lock()
+	defer tss.saveMu.Unlock()
+	tss.txMu.Lock()
+	defer tss.txMu.Unlock()
+
+	if wl := tss.wlog.Swap(nil); wl != nil {
+		wl.close()
+	}
+}
+
+// Appends a write request to the write log, if it is enabled. The write has
+// already been applied, so an error means that it isn't durable.
+func (tss *treeStoreSet) logWrite(index string, args []string) (err error) {
+	if wl := tss.wlog.Load(); wl != nil {
+		if err = wl.append(index, args); err != nil {
+			err = fmt.Errorf("the write was applied but not logged: %w", err)
+		}
+	}
+	return
+}
+
+// Saves the modified databases, waiting for any save in progress to
+// complete first.
 func (tss *treeStoreSet) save(l lane.Lane) error {
-	if tss.dirty.Swap(0) > 0 {
-		l.Trace("saving treestore set")
-		for index, ts := range tss.dbs {
+	tss.saveMu.Lock()
+	defer tss.saveMu.Unlock()
+	return tss.saveLocked(l)
+}
+
+// Starts saving the modified databases in the background, unless a save
+// is already in progress.
+func (tss *treeStoreSet) bgsave(l lane.Lane) (started bool) {
+	if !tss.saveMu.TryLock() {
+		return
+	}
+
+	go func() {
+		defer tss.saveMu.Unlock()
+		tss.saveLocked(l)
+	}()
+	return true
+}
+
+func (tss *treeStoreSet) saveLocked(l lane.Lane) (err error) {
+	// every write logged before this point is for a database that is dirty
+	var logSize int64
+	wl := tss.wlog.Load()
+	if wl != nil {
+		_, logSize = wl.position()
+	}
+
+	dirty := tss.dirtyDbs()
+
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	// the outcome of each attempt is reported by info
+	defer func() {
+		tss.statsMu.Lock()
+		tss.lastSaveErr = err
+		tss.statsMu.Unlock()
+	}()
+
+	l.Trace("saving treestore set")
+	started := time.Now()
+	var totalSize int64
+	var firstErr error
+	for index, changes := range dirty {
+		ts, exists := tss.getDb(l, index, false)
+		if exists {
 			filename := tss.treeStoreFileName(index)
 			l.Tracef("saving %s to %s", index, filename)
-			err := ts.Save(l, filename)
+			size, err := tss.snapshotDb(l, ts, index, filename)
 			if err != nil {
+				// the database remains dirty, to be tried again
 				l.Errorf("failed to save %s to %s: %s", index, filename, err.Error())
-				return err
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
 			}
+			totalSize += size
 		}
+		tss.markSaved(index, changes)
 	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if wl != nil {
+		// the writes logged before the save started are in the snapshots
+		if err := wl.discardBefore(logSize); err != nil {
+			l.Errorf("failed to truncate the write log: %s", err.Error())
+			return err
+		}
+	}
+
+	stats := saveStats{
+		completed: time.Now(),
+		dbs:       len(dirty),
+		bytes:     totalSize,
+	}
+	stats.duration = stats.completed.Sub(started)
+	l.Infof("saved %d database(s), %d bytes in %s", stats.dbs, stats.bytes, stats.duration)
+
+	tss.statsMu.Lock()
+	tss.lastSave = stats
+	tss.statsMu.Unlock()
 	return nil
 }
 
+// Writes a snapshot of a database. Only the serialization locks the
+// database; the file is written and flushed to stable storage after writes
+// resume.
+func (tss *treeStoreSet) snapshotDb(l lane.Lane, ts *treestore.TreeStore, index, filename string) (size int64, err error) {
+	content, seq, err := tss.captureDb(l, ts, index)
+	if err != nil {
+		return
+	}
+
+	return commitSnapshot(content, filename, seq)
+}
+
+// The number of times a database is serialized while writes continue,
+// before it is serialized with writes held off.
+const captureAttempts = 3
+
+// Serializes the database named index, returning the content and the
+// sequence of the last logged write that it includes. The sequence is read
+// with logged writes held off, and the serialization is made after they
+// resume. If a write to the database is logged in the meantime, the
+// content can't be matched to a sequence, and the serialization is made
+// again.
+func (tss *treeStoreSet) captureDb(l lane.Lane, ts *treestore.TreeStore, index string) (content []byte, seq uint64, err error) {
+	wl := tss.wlog.Load()
+	if wl == nil {
+		seq = tss.writeLogSeq()
+		content, err = captureSnapshot(l, ts)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		tss.txMu.Lock()
+		seq, _ = wl.position()
+		if attempt == captureAttempts {
+			// writes to the database keep interleaving; hold them off
+			content, err = captureSnapshot(l, ts)
+			tss.txMu.Unlock()
+			return
+		}
+		tss.txMu.Unlock()
+
+		if content, err = captureSnapshot(l, ts); err != nil {
+			return
+		}
+
+		// logged writes apply and log under the lock, so with it held, a
+		// write made during the serialization is logged
+		tss.txMu.Lock()
+		changed := wl.lastDbSeq(index) > seq
+		tss.txMu.Unlock()
+		if !changed {
+			return
+		}
+		l.Tracef("database %s changed during its serialization, trying again", index)
+	}
+}
+
+func (tss *treeStoreSet) lastSaveStats() saveStats {
+	tss.statsMu.Lock()
+	defer tss.statsMu.Unlock()
+	return tss.lastSave
+}
+
+// Returns the error of the last save attempt, or nil if it succeeded.
+func (tss *treeStoreSet) lastSaveError() error {
+	tss.statsMu.Lock()
+	defer tss.statsMu.Unlock()
+	return tss.lastSaveErr
+}
+
+// Returns the number of unsaved modifications of each database.
+func (tss *treeStoreSet) dirtyDbs() map[string]uint64 {
+	tss.dirtyMu.Lock()
+	defer tss.dirtyMu.Unlock()
+
+	dirty := make(map[string]uint64, len(tss.dirty))
+	for index, changes := range tss.dirty {
+		dirty[index] = changes
+	}
+	return dirty
+}
+
+func (tss *treeStoreSet) getSaveRules() []SaveRule {
+	tss.statsMu.Lock()
+	defer tss.statsMu.Unlock()
+	return tss.saveRules
+}
+
+func (tss *treeStoreSet) setSaveRules(rules []SaveRule) {
+	tss.statsMu.Lock()
+	defer tss.statsMu.Unlock()
+	tss.saveRules = rules
+}
+
+// Returns the number of modifications that are not yet saved.
+func (tss *treeStoreSet) pendingChanges() (changes uint64) {
+	tss.dirtyMu.Lock()
+	defer tss.dirtyMu.Unlock()
+
+	for _, dbChanges := range tss.dirty {
+		changes += dbChanges
+	}
+	return
+}
+
+// Counts a modification of a database that is not yet saved.
+func (tss *treeStoreSet) markDirty(index string) {
+	tss.dirtyMu.Lock()
+	defer tss.dirtyMu.Unlock()
+	tss.dirty[index]++
+	tss.versions[index]++
+}
+
+// Removes the count of changes captured by a save, leaving the database
+// dirty if it was modified during the save.
+func (tss *treeStoreSet) markSaved(index string, changes uint64) {
+	tss.dirtyMu.Lock()
+	defer tss.dirtyMu.Unlock()
+
+	if tss.dirty[index] <= changes {
+		delete(tss.dirty, index)
+	} else {
+		tss.dirty[index] -= changes
+	}
+}
+
+// Sets aside a database file that failed to load, and starts the database
+// over, because a failed load can leave it partially populated.
+func (tss *treeStoreSet) quarantineDbUnlocked(l lane.Lane, index, path string) (err error) {
+	quarantineName, err := quarantineSnapshot(path)
+	if err != nil {
+		l.Errorf("can't quarantine %s: %v", path, err)
+		return
+	}
+	l.Errorf("database %s is corrupt and was moved to %s", index, quarantineName)
+
+	delete(tss.dbs, index)
+	if index == "main" {
+		tss.createDbUnlocked(l, index)
+	}
+	return
+}
+
 func (tss *treeStoreSet) treeStoreFileName(index string) string {
 	if tss.basePath == "" {
 		return ""
@@ -101,9 +511,56 @@ func (tss *treeStoreSet) treeStoreFileName(index string) string {
 	return fmt.Sprintf("%s.%s.db", tss.basePath, index)
 }
 
+// Returns the file of a database, and its size as of the last save, which
+// is zero if the database hasn't been saved.
+func (tss *treeStoreSet) dbFile(index string) (path string, size int64) {
+	path = tss.treeStoreFileName(index)
+	if path != "" {
+		if fi, err := os.Stat(path); err == nil {
+			size = fi.Size()
+		}
+	}
+	return
+}
+
+// Extracts the database name from a file name of <fileBase>.<name>.db.
+func parseDbFileName(fileBase, fileName string) (name string, isDbFile bool) {
+	prefix := fileBase + "."
+	if !strings.HasPrefix(fileName, prefix) || !strings.HasSuffix(fileName, ".db") {
+		return
+	}
+	if len(fileName) <= len(prefix)+len(".db") {
+		return
+	}
+	return fileName[len(prefix) : len(fileName)-len(".db")], true
+}
+
+const maxDbNameLength = 64
+
+// Checks that a database name can be used in its file name. Names are
+// letters, digits, '-' and '_', so that the file name of one database
+// can't be mistaken for another.
+func validateDbName(name string) error {
+	if name == "" {
+		return errors.New("database name can't be empty")
+	}
+	if len(name) > maxDbNameLength {
+		return fmt.Errorf("database name %s is longer than %d characters", name, maxDbNameLength)
+	}
+	for _, ch := range name {
+		if !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z') && !(ch >= '0' && ch <= '9') && ch != '-' && ch != '_' {
+			return fmt.Errorf("database name %s can only contain letters, digits, '-' and '_'", name)
+		}
+	}
+	return nil
+}
+
 func (tss *treeStoreSet) createDbUnlocked(l lane.Lane, index string) (ts *treestore.TreeStore, valid bool) {
 	ts, exists := tss.dbs[index]
 	if !exists {
+		if validateDbName(index) != nil {
+			return
+		}
 		ts = treestore.NewTreeStore(l.Derive(), tss.appVersion)
 		tss.dbs[index] = ts
 	}
@@ -130,6 +587,296 @@ func (tss *treeStoreSet) getDb(l lane.Lane, index string, create bool) (ts *tree
 	return
 }
 
+// Returns the sorted list of database names.
+func (tss *treeStoreSet) dbNames() []string {
+	tss.mu.Lock()
+	defer tss.mu.Unlock()
+
+	names := make([]string, 0, len(tss.dbs))
+	for index := range tss.dbs {
+		names = append(names, index)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Removes a database and its file. Clients that have it selected are moved
+// to main, which can't be dropped.
+func (tss *treeStoreSet) dropDb(l lane.Lane, index string) (err error) {
+	if index == "main" {
+		return errors.New("the main database can't be dropped; use purge to empty it")
+	}
+
+	// a save in progress could write the file of the database after it is
+	// removed
+	tss.saveMu.Lock()
+	defer tss.saveMu.Unlock()
+
+	var logErr error
+	tss.txMu.Lock()
+	ts, exists := tss.getDb(l, index, false)
+	if exists {
+		tss.discardDb(index)
+		logErr = tss.droppedLocked(map[string]*treestore.TreeStore{index: ts})
+	}
+	tss.txMu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("database %s does not exist", index)
+	}
+
+	l.Infof("dropped database %s", index)
+	if err = tss.removeDbFiles([]string{index}); err == nil {
+		err = logErr
+	}
+	return
+}
+
+// Removes every database other than main, and empties main.
+func (tss *treeStoreSet) flushAll(l lane.Lane) (dropped int, err error) {
+	tss.saveMu.Lock()
+	defer tss.saveMu.Unlock()
+
+	var logErr error
+	tss.txMu.Lock()
+	dbs := map[string]*treestore.TreeStore{}
+	for _, index := range tss.dbNames() {
+		ts, _ := tss.getDb(l, index, false)
+		if index == "main" {
+			ts.Purge()
+			tss.markDirty(index)
+			tss.touchKeys(ts, "")
+			logErr = tss.logWrite(index, []string{"purge", "--destructive"})
+		} else {
+			tss.discardDb(index)
+			dbs[index] = ts
+		}
+	}
+	if dropErr := tss.droppedLocked(dbs); logErr == nil {
+		logErr = dropErr
+	}
+	tss.txMu.Unlock()
+
+	names := make([]string, 0, len(dbs))
+	for index := range dbs {
+		names = append(names, index)
+	}
+
+	l.Infof("flushed all databases, dropping %d", len(names))
+	dropped = len(names)
+	if err = tss.removeDbFiles(names); err == nil {
+		err = logErr
+	}
+	return
+}
+
+// Completes the removal of databases from the set, with the transaction
+// lock held. Each drop is logged under the name of the database, so that
+// replay skips it if the database is created again and saved. Returns the
+// first error logging a drop.
+func (tss *treeStoreSet) droppedLocked(dbs map[string]*treestore.TreeStore) (err error) {
+	for index, ts := range dbs {
+		tss.dirtyMu.Lock()
+		delete(tss.dirty, index)
+		tss.dirtyMu.Unlock()
+		delete(tss.snapshotSeq, index)
+
+		tss.touchKeys(ts, "")
+		if logErr := tss.logWrite(index, []string{"dropdb", index, "--destructive"}); err == nil {
+			err = logErr
+		}
+	}
+
+	processAllClients(func(id int64, cs *clientState) {
+		if cs.tss == tss {
+			cs.reselectDb()
+		}
+	})
+	return
+}
+
+// Makes dest a copy of the src database, including its TTLs, metadata,
+// relationships and auto-links. An existing dest is replaced only if
+// overwrite is true. The copy is saved before it is made available.
+func (tss *treeStoreSet) copyDb(l lane.Lane, src, dest string, overwrite bool) (err error) {
+	if err = validateDbName(dest); err != nil {
+		return
+	}
+	if src == dest {
+		return errors.New("the source and destination databases must be different")
+	}
+
+	tss.saveMu.Lock()
+	defer tss.saveMu.Unlock()
+	tss.txMu.Lock()
+	defer tss.txMu.Unlock()
+
+	srcTs, exists := tss.getDb(l, src, false)
+	if !exists {
+		return fmt.Errorf("database %s does not exist", src)
+	}
+	destTs, exists := tss.getDb(l, dest, false)
+	if exists && !overwrite {
+		return fmt.Errorf("database %s already exists", dest)
+	}
+
+	copyTs, err := tss.cloneDbLocked(l, srcTs, dest)
+	if err != nil {
+		return
+	}
+
+	tss.mu.Lock()
+	tss.dbs[dest] = copyTs
+	tss.mu.Unlock()
+
+	tss.dirtyMu.Lock()
+	delete(tss.dirty, dest)
+	tss.dirtyMu.Unlock()
+
+	if exists {
+		// clients using the replaced database move to the copy
+		tss.touchKeys(destTs, "")
+		processAllClients(func(id int64, cs *clientState) {
+			if cs.tss == tss {
+				cs.reselectDb()
+			}
+		})
+	}
+
+	l.Infof("copied database %s to %s", src, dest)
+	return
+}
+
+// Renames the src database to dest, which must not exist. Clients that
+// have src selected follow it to dest.
+func (tss *treeStoreSet) renameDb(l lane.Lane, src, dest string) (err error) {
+	if err = validateDbName(dest); err != nil {
+		return
+	}
+	if src == "main" {
+		return errors.New("the main database can't be renamed; use copydb")
+	}
+
+	tss.saveMu.Lock()
+	defer tss.saveMu.Unlock()
+	tss.txMu.Lock()
+	defer tss.txMu.Unlock()
+
+	ts, exists := tss.getDb(l, src, false)
+	if !exists {
+		return fmt.Errorf("database %s does not exist", src)
+	}
+	if _, exists = tss.getDb(l, dest, false); exists {
+		return fmt.Errorf("database %s already exists", dest)
+	}
+
+	// the database is saved under its new name before the old file is
+	// removed, so that a crash leaves at least one of them
+	if tss.basePath != "" {
+		if _, err = tss.writeDbFileLocked(l, ts, dest); err != nil {
+			return
+		}
+	}
+
+	tss.mu.Lock()
+	delete(tss.dbs, src)
+	tss.dbs[dest] = ts
+	tss.mu.Unlock()
+
+	tss.dirtyMu.Lock()
+	delete(tss.dirty, src)
+	delete(tss.dirty, dest)
+	tss.dirtyMu.Unlock()
+	delete(tss.snapshotSeq, src)
+
+	// writes logged for src are in the file of dest, and must not recreate
+	// src on replay
+	logErr := tss.logWrite(src, []string{"dropdb", src, "--destructive"})
+
+	processAllClients(func(id int64, cs *clientState) {
+		if cs.tss == tss {
+			cs.renameSelectedDb(src, dest)
+		}
+	})
+
+	l.Infof("renamed database %s to %s", src, dest)
+	if err = tss.removeDbFiles([]string{src}); err == nil {
+		err = logErr
+	}
+	return
+}
+
+// Makes a copy of a data store for the database named index, with the
+// transaction lock held. The copy is made by serialization, which carries
+// everything in the data store. If the set is persisted, the serialization
+// becomes the database file of index.
+func (tss *treeStoreSet) cloneDbLocked(l lane.Lane, ts *treestore.TreeStore, index string) (copyTs *treestore.TreeStore, err error) {
+	copyTs = treestore.NewTreeStore(l.Derive(), tss.appVersion)
+
+	seq := tss.writeLogSeq()
+	content, err := captureSnapshot(l, ts)
+	if err != nil {
+		return
+	}
+
+	if tss.basePath == "" {
+		var f *os.File
+		if f, err = os.CreateTemp("", "treestore-copy-*.db"); err != nil {
+			return
+		}
+		tempName := f.Name()
+		f.Close()
+		defer os.Remove(tempName)
+
+		if err = os.WriteFile(tempName, content, 0600); err != nil {
+			return
+		}
+		err = copyTs.Load(l, tempName)
+		return
+	}
+
+	fileName := tss.treeStoreFileName(index)
+	if _, err = commitSnapshot(content, fileName, seq); err != nil {
+		return
+	}
+	err = copyTs.Load(l, fileName)
+	return
+}
+
+// Saves a data store as the file of the database named index, with the
+// transaction lock held.
+func (tss *treeStoreSet) writeDbFileLocked(l lane.Lane, ts *treestore.TreeStore, index string) (size int64, err error) {
+	seq := tss.writeLogSeq()
+	content, err := captureSnapshot(l, ts)
+	if err != nil {
+		return
+	}
+	return commitSnapshot(content, tss.treeStoreFileName(index), seq)
+}
+
+// Returns the sequence of the last logged write, which a snapshot taken now
+// includes.
+func (tss *treeStoreSet) writeLogSeq() uint64 {
+	if wl := tss.wlog.Load(); wl != nil {
+		seq, _ := wl.position()
+		return seq
+	}
+	return tss.logSeq
+}
+
+func (tss *treeStoreSet) removeDbFiles(names []string) (err error) {
+	for _, index := range names {
+		filename := tss.treeStoreFileName(index)
+		if filename == "" {
+			continue
+		}
+		if rmErr := os.Remove(filename); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) && err == nil {
+			err = rmErr
+		}
+	}
+	return
+}
+
 func (tss *treeStoreSet) discardDb(index string) {
 	tss.mu.Lock()
 	defer tss.mu.Unlock()
@@ -144,7 +891,341 @@ func (tss *treeStoreSet) discardAll() {
 	tss.dbs = map[string]*treestore.TreeStore{}
 }
 
+// Starts tracking modifications to a key, returning its current version.
+func (tss *treeStoreSet) watchKey(wk watchKey) uint64 {
+	tss.watchMu.Lock()
+	defer tss.watchMu.Unlock()
+
+	w, exists := tss.watched[wk]
+	if !exists {
+		w = &watchedKey{}
+		tss.watched[wk] = w
+	}
+	w.refs++
+	return w.version
+}
+
+// Releases a reference made by watchKey.
+func (tss *treeStoreSet) unwatchKey(wk watchKey) {
+	tss.watchMu.Lock()
+	defer tss.watchMu.Unlock()
+
+	w, exists := tss.watched[wk]
+	if exists {
+		w.refs--
+		if w.refs <= 0 {
+			delete(tss.watched, wk)
+		}
+	}
+}
+
+func (tss *treeStoreSet) watchedKeyVersion(wk watchKey) uint64 {
+	tss.watchMu.Lock()
+	defer tss.watchMu.Unlock()
+
+	w, exists := tss.watched[wk]
+	if !exists {
+		return 0
+	}
+	return w.version
+}
+
+// Advances the version of every watched key that is affected by a change
+// to the specified keys. A change to a key affects watches on the key
+// itself, its ancestors and its descendants. An empty key affects the
+// entire data store.
+func (tss *treeStoreSet) touchKeys(ts *treestore.TreeStore, keys ...treestore.TokenPath) {
+	tss.watchMu.Lock()
+	defer tss.watchMu.Unlock()
+
+	if len(tss.watched) == 0 && len(tss.waiters) == 0 {
+		return
+	}
+
+	tss.watchSeq++
+	for wk, w := range tss.watched {
+		if isAffectedKey(wk, ts, keys) {
+			w.version = tss.watchSeq
+		}
+	}
+
+	for cs, wk := range tss.waiters {
+		if isAffectedKey(wk, ts, keys) {
+			cs.unblock(unblockChanged, false)
+		}
+	}
+}
+
+// Registers a blocked client to be unblocked when a key changes.
+func (tss *treeStoreSet) addWaiter(cs *clientState, wk watchKey) {
+	tss.watchMu.Lock()
+	defer tss.watchMu.Unlock()
+	tss.waiters[cs] = wk
+}
+
+func (tss *treeStoreSet) removeWaiter(cs *clientState) {
+	tss.watchMu.Lock()
+	defer tss.watchMu.Unlock()
+	delete(tss.waiters, cs)
+}
+
+func isAffectedKey(wk watchKey, ts *treestore.TreeStore, keys []treestore.TokenPath) bool {
+	if wk.ts != ts {
+		return false
+	}
+	for _, key := range keys {
+		if isRelatedKey(wk.key, strings.TrimSuffix(string(key), "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRelatedKey(a, b string) bool {
+	if a == b {
+		return true
+	}
+	return strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// Returns a copy of the user, which is safe from concurrent changes.
 func (tss *treeStoreSet) getUser(userName string) (tsu *treeStoreUser, exists bool) {
-	tsu, exists = tss.users[userName]
+	tss.mu.Lock()
+	defer tss.mu.Unlock()
+
+	user, exists := tss.users[userName]
+	if exists {
+		userCopy := *user
+		tsu = &userCopy
+	}
+	return
+}
+
+// Returns the sorted list of user names.
+func (tss *treeStoreSet) userNames() []string {
+	tss.mu.Lock()
+	defer tss.mu.Unlock()
+
+	names := make([]string, 0, len(tss.users))
+	for name := range tss.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Creates a user or replaces the user's password. If noPass is true, the
+// user's password is removed and any password is accepted.
+func (tss *treeStoreSet) setUserPassword(l lane.Lane, userName, password string, noPass bool) (created bool, err error) {
+	tss.mu.Lock()
+	tsu, exists := tss.users[userName]
+	if !exists {
+		tsu = newTreeStoreUser()
+	}
+
+	if noPass {
+		tsu.setNoPass()
+	} else if err = tsu.setPassword(password); err != nil {
+		tss.mu.Unlock()
+		return
+	}
+
+	tss.users[userName] = tsu
+	tss.mu.Unlock()
+
+	created = !exists
+	err = tss.saveUsers(l)
+	return
+}
+
+func (tss *treeStoreSet) getUserPermissions(userName string) (perms userPermissionsJson, exists bool) {
+	tss.mu.Lock()
+	defer tss.mu.Unlock()
+
+	tsu, exists := tss.users[userName]
+	if !exists {
+		return
+	}
+
+	perms = userPermissionsJson{
+		HasPassword: tsu.hasPassword(),
+		NoPass:      tsu.NoPass,
+		Categories:  unrestrictedAsWildcard(tsu.Categories),
+		Databases:   unrestrictedAsWildcard(tsu.Databases),
+		KeyPatterns: unrestrictedAsWildcard(tsu.KeyPatterns),
+	}
+	return
+}
+
+func unrestrictedAsWildcard(list []string) []string {
+	if list == nil {
+		return []string{"*"}
+	}
+	return list
+}
+
+// Replaces the permission lists specified in lists, keyed by categories,
+// databases and keypatterns. A nil list is unrestricted.
+func (tss *treeStoreSet) setUserPermissions(l lane.Lane, userName string, lists map[string][]string) (err error) {
+	tss.mu.Lock()
+	tsu, exists := tss.users[userName]
+	if !exists {
+		tss.mu.Unlock()
+		err = fmt.Errorf("user %s does not exist", userName)
+		return
+	}
+
+	if list, specified := lists["categories"]; specified {
+		tsu.Categories = list
+	}
+	if list, specified := lists["databases"]; specified {
+		tsu.Databases = list
+	}
+	if list, specified := lists["keypatterns"]; specified {
+		tsu.KeyPatterns = list
+	}
+	tss.mu.Unlock()
+
+	err = tss.saveUsers(l)
+	return
+}
+
+func (tss *treeStoreSet) deleteUser(l lane.Lane, userName string) (existed bool, err error) {
+	if userName == "default" {
+		err = errors.New("the default user cannot be deleted")
+		return
+	}
+
+	tss.mu.Lock()
+	if _, existed = tss.users[userName]; existed {
+		delete(tss.users, userName)
+	}
+	tss.mu.Unlock()
+
+	if existed {
+		err = tss.saveUsers(l)
+	}
+	return
+}
+
+func (tss *treeStoreSet) isAuthRequired() bool {
+	tss.mu.Lock()
+	defer tss.mu.Unlock()
+	return tss.requireAuth
+}
+
+func (tss *treeStoreSet) setAuthRequired(l lane.Lane, required bool) error {
+	tss.mu.Lock()
+	tss.requireAuth = required
+	tss.mu.Unlock()
+
+	return tss.saveUsers(l)
+}
+
+func (tss *treeStoreSet) usersFileName() string {
+	if tss.basePath == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s.users", tss.basePath)
+}
+
+func (tss *treeStoreSet) loadUsers(l lane.Lane) (err error) {
+	filename := tss.usersFileName()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		} else {
+			l.Errorf("error loading users from %s: %v", filename, err)
+		}
+		return
+	}
+
+	uf := usersFile{}
+	if err = json.Unmarshal(data, &uf); err != nil {
+		l.Errorf("error loading users from %s: %v", filename, err)
+		return
+	}
+
+	if uf.Users != nil {
+		tss.users = uf.Users
+	}
+	if _, exists := tss.users["default"]; !exists {
+		tss.users["default"] = newDefaultUser()
+	}
+	tss.requireAuth = uf.RequireAuth
+
+	l.Tracef("users loaded: %d", len(tss.users))
+	return
+}
+
+// Writes the user accounts, if the set is persisted. The accounts are
+// copied under tss.mu and written after it is released; usersFileMu orders
+// the writes, so the last one has the latest accounts. The file is replaced
+// atomically so that a crash cannot leave a partial user list.
+func (tss *treeStoreSet) saveUsers(l lane.Lane) (err error) {
+	filename := tss.usersFileName()
+	if filename == "" {
+		return
+	}
+
+	tss.usersFileMu.Lock()
+	defer tss.usersFileMu.Unlock()
+
+	tss.mu.Lock()
+	uf := usersFile{
+		RequireAuth: tss.requireAuth,
+		Users:       tss.users,
+	}
+	data, err := json.Marshal(&uf)
+	tss.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	tempName := filename + ".tmp"
+	if err = os.WriteFile(tempName, data, 0600); err != nil {
+		l.Errorf("failed to save users to %s: %v", tempName, err)
+		return
+	}
+
+	if err = os.Rename(tempName, filename); err != nil {
+		l.Errorf("failed to save users to %s: %v", filename, err)
+		return
+	}
+
+	return
+}
+
+const keyCountsMaxAge = time.Minute
+
+// Returns the number of keys and keys with values in a database, counting
+// them only if the database changed since they were last counted.
+func (tss *treeStoreSet) keyCounts(index string, ts *treestore.TreeStore) (keys, values int) {
+	tss.dirtyMu.Lock()
+	version := tss.versions[index]
+	tss.dirtyMu.Unlock()
+
+	tss.countsMu.Lock()
+	defer tss.countsMu.Unlock()
+
+	kc := tss.counts[index]
+	if kc == nil || kc.ts != ts || kc.version != version || time.Since(kc.counted) > keyCountsMaxAge {
+		kc = &keyCounts{ts: ts, version: version, counted: time.Now()}
+		kc.keys, kc.values = treeStoreKeyCounts(ts)
+		tss.counts[index] = kc
+	}
+	return kc.keys, kc.values
+}
+
+// Counts the keys and the keys with values in a data store.
+func treeStoreKeyCounts(ts *treestore.TreeStore) (keys, values int) {
+	matches := ts.GetMatchingKeys(treestore.MakeStoreKeyFromPath("/**"), 0, math.MaxInt32, false)
+	keys = len(matches)
+	for _, km := range matches {
+		if km.HasValue {
+			values++
+		}
+	}
 	return
 }
@@ -1,11 +1,181 @@
 package treestore_cmdline
 
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
 type (
+	// treeStoreUser holds the credentials and permissions of a user account.
+	// A user without a password hash can authenticate only if marked NoPass,
+	// which accepts any password.
+	//
+	// A nil permission list is unrestricted. Categories are the command
+	// categories (read, write, admin) the user can run, Databases are the
+	// database names the user can access, and KeyPatterns are the key
+	// patterns (such as /reports/**) the user can access.
 	treeStoreUser struct {
-		// for later
+		Salt        []byte   `json:"salt,omitempty"`
+		Hash        []byte   `json:"hash,omitempty"`
+		Iterations  int      `json:"iterations,omitempty"`
+		Categories  []string `json:"categories"`
+		Databases   []string `json:"databases"`
+		KeyPatterns []string `json:"key_patterns"`
+		NoPass      bool     `json:"nopass,omitempty"`
 	}
 )
 
+const passwordIterations = 100000
+
 func newTreeStoreUser() *treeStoreUser {
 	return &treeStoreUser{}
 }
+
+// The default user needs no password, so that clients can connect without
+// authenticating until authentication is required.
+func newDefaultUser() *treeStoreUser {
+	return &treeStoreUser{NoPass: true}
+}
+
+func (tsu *treeStoreUser) hasPassword() bool {
+	return len(tsu.Hash) > 0
+}
+
+// Replaces the password, storing only a salted hash of it.
+func (tsu *treeStoreUser) setPassword(password string) (err error) {
+	if password == "" {
+		err = errors.New("password cannot be empty")
+		return
+	}
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+
+	tsu.Salt = salt
+	tsu.Iterations = passwordIterations
+	tsu.Hash = hashPassword(password, salt, passwordIterations)
+	tsu.NoPass = false
+	return
+}
+
+// Removes the password, allowing authentication with any password.
+func (tsu *treeStoreUser) setNoPass() {
+	tsu.Salt = nil
+	tsu.Iterations = 0
+	tsu.Hash = nil
+	tsu.NoPass = true
+}
+
+func (tsu *treeStoreUser) checkPassword(password string) bool {
+	if !tsu.hasPassword() {
+		return tsu.NoPass
+	}
+
+	hash := hashPassword(password, tsu.Salt, tsu.Iterations)
+	return subtle.ConstantTimeCompare(hash, tsu.Hash) == 1
+}
+
+// PBKDF2 with HMAC-SHA256, producing a 32-byte hash.
+func hashPassword(password string, salt []byte, iterations int) []byte {
+	return pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+}
+
+func (tsu *treeStoreUser) allowsCategory(category string) bool {
+	if category == cmdCategoryConnection || tsu.Categories == nil {
+		return true
+	}
+	for _, allowed := range tsu.Categories {
+		if allowed == category {
+			return true
+		}
+	}
+	return false
+}
+
+func (tsu *treeStoreUser) allowsDatabase(index string) bool {
+	if tsu.Databases == nil {
+		return true
+	}
+	for _, allowed := range tsu.Databases {
+		if allowed == index {
+			return true
+		}
+	}
+	return false
+}
+
+func (tsu *treeStoreUser) hasKeyRestrictions() bool {
+	return tsu.KeyPatterns != nil
+}
+
+// Indicates if a key path, or every key matched by a key pattern, is
+// covered by one of the user's key patterns.
+func (tsu *treeStoreUser) allowsKey(key string) bool {
+	if tsu.KeyPatterns == nil {
+		return true
+	}
+
+	requested := splitKeyPattern(key)
+	for _, allowed := range tsu.KeyPatterns {
+		if keyPatternCovers(splitKeyPattern(allowed), requested) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitKeyPattern(pattern string) []string {
+	pattern = strings.Trim(pattern, "/")
+	if pattern == "" {
+		return []string{}
+	}
+	return strings.Split(pattern, "/")
+}
+
+// Segment-wise pattern coverage, where "**" matches any number of
+// segments and other wildcards match within a segment. A wildcard in the
+// requested pattern is only covered by the identical wildcard or by a
+// bare "*" or "**" in the allowed pattern.
+func keyPatternCovers(allowed, requested []string) bool {
+	if len(allowed) == 0 {
+		return len(requested) == 0
+	}
+
+	if allowed[0] == "**" {
+		if len(allowed) == 1 {
+			return true
+		}
+		for i := 0; i <= len(requested); i++ {
+			if keyPatternCovers(allowed[1:], requested[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(requested) == 0 {
+		return false
+	}
+
+	seg := requested[0]
+	if seg == "**" {
+		// only covered by a trailing "**"
+		return false
+	} else if strings.Contains(seg, "*") {
+		if seg != allowed[0] && allowed[0] != "*" {
+			return false
+		}
+	} else if matched, _ := path.Match(allowed[0], seg); !matched {
+		return false
+	}
+
+	return keyPatternCovers(allowed[1:], requested[1:])
+}
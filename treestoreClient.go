@@ -23,5 +23,6 @@ type (
 		ServerAddr() string
 		ClientAddr() string
 		ServerNow() time.Time
+		PeerCertificateSubject() string
 	}
 )
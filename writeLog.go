@@ -0,0 +1,342 @@
+package treestore_cmdline
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jimsnab/go-lane"
+)
+
+// WriteLogFsync specifies when the write log is flushed to stable storage.
+type WriteLogFsync int
+
+const (
+	// Fsync once per second; a crash can lose up to a second of writes
+	WriteLogFsyncEverySecond WriteLogFsync = iota
+
+	// Fsync before each write command responds
+	WriteLogFsyncAlways
+
+	// Leave flushing to the operating system
+	WriteLogFsyncNever
+)
+
+type (
+	// writeLog is an append-only log of the write requests applied since
+	// the last snapshot. Each record holds a sequence number, the database
+	// name and the request args, framed as:
+	//
+	//	<uint32 length> <uint32 crc32> <payload>
+	//
+	// where the payload is <uint64 sequence> followed by <uint32 length>
+	// <bytes> fields. A snapshot records the sequence number of the last
+	// write it includes, so that replay skips writes already in a snapshot.
+	writeLog struct {
+		mu       sync.Mutex
+		l        lane.Lane
+		fileName string
+		f        *os.File
+		fsync    WriteLogFsync
+		seq      uint64
+		dbSeq    map[string]uint64 // last sequence logged for each database
+		size     int64
+		unsynced bool
+		exit     chan struct{}
+		exited   chan struct{}
+	}
+)
+
+var errWriteLogRecord = errors.New("invalid write log record")
+
+// Records are limited in size, so that replay doesn't allocate a buffer
+// for the length in a corrupt header.
+const maxWriteLogRecordSize = 256 * 1024 * 1024
+
+// Opens the write log for appending. Sequence numbers continue after
+// lastSeq.
+func openWriteLog(l lane.Lane, fileName string, fsync WriteLogFsync, lastSeq uint64) (wl *writeLog, err error) {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	wl = &writeLog{
+		l:        l,
+		fileName: fileName,
+		f:        f,
+		fsync:    fsync,
+		seq:      lastSeq,
+		dbSeq:    map[string]uint64{},
+		size:     fi.Size(),
+	}
+
+	if fsync == WriteLogFsyncEverySecond {
+		wl.exit = make(chan struct{})
+		wl.exited = make(chan struct{})
+		go wl.syncLoop()
+	}
+	return
+}
+
+func (wl *writeLog) syncLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wl.exit:
+			close(wl.exited)
+			return
+		case <-ticker.C:
+			wl.mu.Lock()
+			if wl.unsynced {
+				if err := wl.f.Sync(); err != nil {
+					wl.l.Errorf("write log sync failed: %s", err)
+				}
+				wl.unsynced = false
+			}
+			wl.mu.Unlock()
+		}
+	}
+}
+
+// Appends a request applied to the database named index.
+func (wl *writeLog) append(index string, args []string) (err error) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	record := encodeWriteLogRecord(wl.seq+1, index, args)
+	if len(record)-8 > maxWriteLogRecordSize {
+		err = fmt.Errorf("write log record of %d bytes exceeds the limit of %d", len(record)-8, maxWriteLogRecordSize)
+		wl.l.Errorf("write log append failed: %s", err)
+		return
+	}
+	if _, err = wl.f.Write(record); err != nil {
+		wl.l.Errorf("write log append failed: %s", err)
+		return
+	}
+	wl.seq++
+	wl.dbSeq[index] = wl.seq
+	wl.size += int64(len(record))
+
+	if wl.fsync == WriteLogFsyncAlways {
+		if err = wl.f.Sync(); err != nil {
+			wl.l.Errorf("write log sync failed: %s", err)
+		}
+	} else {
+		wl.unsynced = true
+	}
+	return
+}
+
+// Returns the sequence number of the last logged write, and the log size
+// that includes it.
+func (wl *writeLog) position() (seq uint64, size int64) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	return wl.seq, wl.size
+}
+
+// Returns the sequence number of the last write logged for the database
+// named index, or zero if there is none since the log was opened.
+func (wl *writeLog) lastDbSeq(index string) uint64 {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	return wl.dbSeq[index]
+}
+
+// Discards the start of the log, before offset, which is done after the
+// writes are captured by snapshots. The remainder is written to a new
+// file that replaces the log.
+func (wl *writeLog) discardBefore(offset int64) (err error) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	src, err := os.Open(wl.fileName)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	tempName := wl.fileName + ".tmp"
+	dest, err := os.OpenFile(tempName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+
+	remaining, err := io.Copy(dest, io.NewSectionReader(src, offset, wl.size-offset))
+	if err == nil {
+		err = dest.Sync()
+	}
+	dest.Close()
+	if err == nil {
+		err = os.Rename(tempName, wl.fileName)
+	}
+	if err != nil {
+		os.Remove(tempName)
+		return
+	}
+
+	// continue appending to the replacement
+	f, err := os.OpenFile(wl.fileName, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	wl.f.Close()
+	wl.f = f
+	wl.size = remaining
+	wl.unsynced = false
+	return
+}
+
+func (wl *writeLog) close() {
+	if wl.exit != nil {
+		wl.exit <- struct{}{}
+		<-wl.exited
+	}
+
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	if err := wl.f.Sync(); err != nil {
+		wl.l.Errorf("write log sync failed: %s", err)
+	}
+	wl.f.Close()
+}
+
+func encodeWriteLogRecord(seq uint64, index string, args []string) []byte {
+	fields := append([]string{index}, args...)
+
+	size := 16
+	for _, field := range fields {
+		size += 4 + len(field)
+	}
+
+	record := make([]byte, size)
+	binary.BigEndian.PutUint64(record[8:], seq)
+	pos := 16
+	for _, field := range fields {
+		binary.BigEndian.PutUint32(record[pos:], uint32(len(field)))
+		pos += 4
+		pos += copy(record[pos:], field)
+	}
+
+	binary.BigEndian.PutUint32(record, uint32(size-8))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(record[8:]))
+	return record
+}
+
+func decodeWriteLogPayload(payload []byte) (seq uint64, index string, args []string, err error) {
+	if len(payload) < 8 {
+		err = errWriteLogRecord
+		return
+	}
+	seq = binary.BigEndian.Uint64(payload)
+	payload = payload[8:]
+
+	fields := []string{}
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			err = errWriteLogRecord
+			return
+		}
+		length := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		if uint32(len(payload)) < length {
+			err = errWriteLogRecord
+			return
+		}
+		fields = append(fields, string(payload[:length]))
+		payload = payload[length:]
+	}
+
+	if len(fields) < 2 {
+		err = errWriteLogRecord
+		return
+	}
+
+	index = fields[0]
+	args = fields[1:]
+	return
+}
+
+// Reads the write log, calling apply for each record. A torn or corrupt
+// record at the end of the log, such as from a crash in the middle of an
+// append, ends the replay and is cut from the file.
+func replayWriteLog(l lane.Lane, fileName string, apply func(seq uint64, index string, args []string) error) (records int, err error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0600)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	r := bufio.NewReader(f)
+	var validSize int64
+	header := make([]byte, 8)
+	for {
+		if _, err = io.ReadFull(r, header); err != nil {
+			break
+		}
+
+		// a length beyond the limit or the end of the file is a torn header
+		length := int64(binary.BigEndian.Uint32(header))
+		if length > maxWriteLogRecordSize || length > fi.Size()-validSize-int64(len(header)) {
+			err = errWriteLogRecord
+			break
+		}
+
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			err = errWriteLogRecord
+			break
+		}
+
+		var seq uint64
+		var index string
+		var args []string
+		if seq, index, args, err = decodeWriteLogPayload(payload); err != nil {
+			break
+		}
+
+		if err = apply(seq, index, args); err != nil {
+			l.Warnf("write log record %d did not apply: %s", records+1, err)
+		}
+		records++
+		validSize += int64(len(header) + len(payload))
+	}
+
+	if errors.Is(err, io.EOF) {
+		err = nil
+		return
+	}
+
+	l.Warnf("write log %s ends with an incomplete record after %d record(s), discarding the remainder: %s", fileName, records, err)
+	if err = f.Truncate(validSize); err != nil {
+		err = fmt.Errorf("can't truncate write log %s: %w", fileName, err)
+	}
+	return
+}